@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	accesslog "github.com/moolen/bent/envoy/service/accesslog/v2"
+	"github.com/moolen/bent/pkg/als"
+)
+
+var (
+	grpcAddr string
+	httpAddr string
+	edgeTTL  time.Duration
+	gateways string
+)
+
+func main() {
+	flag.StringVar(&grpcAddr, "grpc-addr", ":9001", "address of the gRPC access log service")
+	flag.StringVar(&httpAddr, "http-addr", ":9002", "address which serves /metrics and /graph")
+	flag.DurationVar(&edgeTTL, "edge-ttl", time.Hour, "duration after which edges and nodes without requests are removed, 0 keeps them")
+	flag.StringVar(&gateways, "gateways", "ingress", "comma-separated node ids of the gateways which are reported by their node id")
+	flag.Parse()
+
+	stats := als.NewStats(edgeTTL, strings.Split(gateways, ",")...)
+	grpcServer := grpc.NewServer()
+	accesslog.RegisterAccessLogServiceServer(grpcServer, als.NewServer(stats))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", stats.MetricsHandler)
+	mux.HandleFunc("/graph", stats.GraphHandler)
+	go func() {
+		if err := http.ListenAndServe(httpAddr, mux); err != nil {
+			log.Fatalf("error starting http server: %s", err)
+		}
+	}()
+
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatalf("error listening on %s: %s", grpcAddr, err)
+	}
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Printf("error starting server: %s", err)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/moolen/bent/envoy/api/v2"
 	discovery "github.com/moolen/bent/envoy/service/discovery/v2"
 	"github.com/moolen/bent/pkg/cache"
+	"github.com/moolen/bent/pkg/dns"
 	"github.com/moolen/bent/pkg/provider"
 	"github.com/moolen/bent/pkg/provider/fargate"
 	"github.com/moolen/bent/pkg/provider/file"
@@ -22,13 +25,30 @@ var (
 	providerType string
 	providerImpl provider.ServiceProvider
 	configFile   string
+	meshFile     string
+	dnsAddr      string
+	dnsUpstream  string
+	dnsAnswer    string
+	statusAddr   string
+	printAnn     bool
 )
 
 func main() {
 	flag.StringVar(&providerType, "provider", "fargate", "set the provider, oneof [fargate,file]")
 	flag.StringVar(&configFile, "config", "", "path to the configuration file")
+	flag.StringVar(&meshFile, "mesh-config", "", "path to a file with a mesh config, overrides the mesh config of the provider")
+	flag.StringVar(&dnsAddr, "dns-addr", "", "address of the embedded DNS server, e.g. :53, disabled if empty")
+	flag.StringVar(&dnsUpstream, "dns-upstream", "169.254.169.253:53", "upstream DNS server which resolves all other names")
+	flag.StringVar(&dnsAnswer, "dns-answer", "127.0.0.1", "IPv4 address which is returned for the service names")
+	flag.StringVar(&statusAddr, "status-addr", "", "address of the status endpoint, e.g. :8080, disabled if empty")
+	flag.BoolVar(&printAnn, "print-annotations", false, "print the annotation reference and exit")
 	flag.Parse()
 
+	if printAnn {
+		fmt.Print(provider.AnnotationReference())
+		return
+	}
+
 	var err error
 	log.SetLevel(log.DebugLevel)
 	config := cache.NewSnapshotCache(false)
@@ -50,6 +70,44 @@ func main() {
 	}
 
 	updater := provider.NewUpdater(config, providerImpl)
+	if meshFile != "" {
+		meshProvider, err := file.NewProvider(meshFile)
+		if err != nil {
+			panic(err)
+		}
+		updater.SetMeshConfigProvider(meshProvider)
+	}
+	if dnsAddr != "" {
+		answer := net.ParseIP(dnsAnswer)
+		if answer == nil || answer.To4() == nil {
+			panic(fmt.Errorf("invalid dns answer: %s", dnsAnswer))
+		}
+		dnsServer := dns.NewServer(answer, dnsUpstream)
+		updater.SetNameRegistry(dnsServer)
+		conn, err := net.ListenPacket("udp", dnsAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := dnsServer.Serve(conn); err != nil {
+				log.Errorf("error serving dns: %s", err)
+			}
+		}()
+	}
+	if statusAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"annotationErrors": updater.AnnotationErrors(),
+			})
+		})
+		go func() {
+			if err := http.ListenAndServe(statusAddr, mux); err != nil {
+				log.Errorf("error serving status: %s", err)
+			}
+		}()
+	}
 	server := xds.NewServer(config, nil)
 	grpcServer := grpc.NewServer()
 	lis, _ := net.Listen("tcp", ":50000")
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/moolen/bent/pkg/iptables"
+)
+
+var (
+	proxyPort    uint
+	proxyUID     uint
+	excludePorts string
+	excludeCIDRs string
+)
+
+// prints the iptables rules which a sidecar entrypoint should apply
+// e.g. bent-iptables -uid 1337 | sh
+func main() {
+	flag.UintVar(&proxyPort, "port", 15001, "port of the transparent listener")
+	flag.UintVar(&proxyUID, "uid", 1337, "user id of the envoy process")
+	flag.StringVar(&excludePorts, "exclude-ports", "", "comma-separated destination ports which are not redirected")
+	flag.StringVar(&excludeCIDRs, "exclude-cidrs", "169.254.0.0/16", "comma-separated destination ranges which are not redirected")
+	flag.Parse()
+
+	cfg := iptables.Config{
+		ProxyPort:    uint32(proxyPort),
+		ProxyUID:     uint32(proxyUID),
+		ExcludeCIDRs: splitList(excludeCIDRs),
+	}
+	for _, port := range splitList(excludePorts) {
+		num, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			log.Fatalf("invalid port %s: %s", port, err)
+		}
+		cfg.ExcludePorts = append(cfg.ExcludePorts, uint32(num))
+	}
+	for _, rule := range iptables.Rules(cfg) {
+		fmt.Println(rule)
+	}
+}
+
+func splitList(in string) []string {
+	var out []string
+	for _, item := range strings.Split(in, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -22,6 +22,7 @@ data "template_file" "beta" {
   vars {
       NAME = "beta.svc"
       TARGET = "http://gamma.svc/from/beta,http://zeta.svc/from/beta"
+      DEPENDENCIES = "gamma.svc,zeta.svc"
       ENVOY_XDS_HOST = "${aws_lb.xds.dns_name}"
       ENVOY_JAEGER_AGENT_HOST = "${aws_instance.jaeger.private_ip}"
   }
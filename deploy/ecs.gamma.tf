@@ -22,6 +22,7 @@ data "template_file" "gamma" {
   vars {
       NAME = "gamma.svc"
       TARGET = "http://delta.svc/from/gamma,http://eta.svc/from/gamma,http://epsilon.svc/from/gamma"
+      DEPENDENCIES = "delta.svc,eta.svc,epsilon.svc"
       ENVOY_XDS_HOST = "${aws_lb.xds.dns_name}"
       ENVOY_JAEGER_AGENT_HOST = "${aws_instance.jaeger.private_ip}"
   }
@@ -0,0 +1,99 @@
+// Package als provides an implementation of the envoy AccessLogService
+// which aggregates the access logs of the sidecars into a service graph.
+package als
+
+import (
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	alsdata "github.com/moolen/bent/envoy/data/accesslog/v2"
+	accesslog "github.com/moolen/bent/envoy/service/accesslog/v2"
+)
+
+const (
+	// localClusterPrefix is the prefix of the clusters
+	// which point to the services of the sidecar node
+	localClusterPrefix = "local_"
+
+	// versionSeparator separates the service and version of a version cluster
+	versionSeparator = "@"
+
+	// unknownDestination is the destination of the requests
+	// which did not match a service
+	unknownDestination = "unknown"
+
+	// unknownSource is the source of the requests
+	// of nodes which are not known to expose a service
+	unknownSource = "unknown"
+)
+
+// Server implements the envoy AccessLogService
+// and records the requests of every edge (caller service -> callee service)
+type Server struct {
+	stats *Stats
+}
+
+// NewServer returns a new Server which records the edges in stats
+func NewServer(stats *Stats) *Server {
+	return &Server{
+		stats: stats,
+	}
+}
+
+// StreamAccessLogs implements the accesslog.AccessLogServiceServer interface
+// only the first message of a stream contains the node identifier
+func (s *Server) StreamAccessLogs(stream accesslog.AccessLogService_StreamAccessLogsServer) error {
+	var node string
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&accesslog.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			log.Debugf("error receiving access logs of node %s: %s", node, err)
+			return err
+		}
+		if msg.Identifier != nil && msg.Identifier.Node != nil {
+			node = msg.Identifier.Node.Id
+		}
+		httpLogs := msg.GetHttpLogs()
+		if httpLogs == nil {
+			continue
+		}
+		for _, entry := range httpLogs.LogEntry {
+			s.record(node, entry)
+		}
+	}
+}
+
+// record adds the log entry to the edge stats.
+// The ingress side of a sidecar (local clusters) only tells which services
+// the node exposes because the caller already reports the request
+func (s *Server) record(node string, entry *alsdata.HTTPAccessLogEntry) {
+	if entry == nil || entry.CommonProperties == nil {
+		return
+	}
+	cluster := entry.CommonProperties.UpstreamCluster
+	if strings.HasPrefix(cluster, localClusterPrefix) {
+		s.stats.AddService(node, strings.TrimPrefix(cluster, localClusterPrefix))
+		return
+	}
+	// no upstream cluster: e.g. no route matched
+	// the authority is chosen by the caller, it must not become a label
+	destination := strings.SplitN(cluster, versionSeparator, 2)[0]
+	if destination == "" {
+		destination = unknownDestination
+	}
+
+	var code uint32
+	if entry.Response != nil && entry.Response.ResponseCode != nil {
+		code = entry.Response.ResponseCode.Value
+	}
+	var latency float64
+	if d := entry.CommonProperties.TimeToLastDownstreamTxByte; d != nil {
+		latency = float64(d.Nanoseconds()) / 1e6
+	}
+	s.stats.Record(node, destination, code, latency)
+}
@@ -0,0 +1,178 @@
+package als
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/moolen/bent/envoy/api/v2/core"
+	alsdata "github.com/moolen/bent/envoy/data/accesslog/v2"
+	accesslog "github.com/moolen/bent/envoy/service/accesslog/v2"
+)
+
+type mockStream struct {
+	grpc.ServerStream
+	msgs   []*accesslog.StreamAccessLogsMessage
+	closed bool
+}
+
+func (m *mockStream) Recv() (*accesslog.StreamAccessLogsMessage, error) {
+	if len(m.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := m.msgs[0]
+	m.msgs = m.msgs[1:]
+	return msg, nil
+}
+
+func (m *mockStream) SendAndClose(*accesslog.StreamAccessLogsResponse) error {
+	m.closed = true
+	return nil
+}
+
+func httpLogs(entries ...*alsdata.HTTPAccessLogEntry) *accesslog.StreamAccessLogsMessage_HttpLogs {
+	return &accesslog.StreamAccessLogsMessage_HttpLogs{
+		HttpLogs: &accesslog.StreamAccessLogsMessage_HTTPAccessLogEntries{
+			LogEntry: entries,
+		},
+	}
+}
+
+func logEntry(cluster string, code uint32, latency time.Duration) *alsdata.HTTPAccessLogEntry {
+	return &alsdata.HTTPAccessLogEntry{
+		CommonProperties: &alsdata.AccessLogCommon{
+			UpstreamCluster:            cluster,
+			TimeToLastDownstreamTxByte: &latency,
+		},
+		Response: &alsdata.HTTPResponseProperties{
+			ResponseCode: &types.UInt32Value{Value: code},
+		},
+	}
+}
+
+func TestStreamAccessLogs(t *testing.T) {
+	stats := NewStats(0)
+	server := NewServer(stats)
+	stream := &mockStream{
+		msgs: []*accesslog.StreamAccessLogsMessage{
+			{
+				Identifier: &accesslog.StreamAccessLogsMessage_Identifier{
+					Node:    &core.Node{Id: "alpha.1"},
+					LogName: "egress_route",
+				},
+				LogEntries: httpLogs(
+					// the ingress side identifies the services of the node
+					logEntry("local_alpha.svc", 200, time.Millisecond),
+					logEntry("beta.svc", 200, time.Millisecond*10),
+					logEntry("beta.svc@v2", 503, time.Millisecond*30),
+				),
+			},
+			{
+				// subsequent messages don't contain the identifier
+				LogEntries: httpLogs(
+					logEntry("gamma.svc", 200, time.Millisecond*5),
+					// no route matched
+					&alsdata.HTTPAccessLogEntry{
+						CommonProperties: &alsdata.AccessLogCommon{},
+						Request:          &alsdata.HTTPRequestProperties{Authority: "random.host"},
+					},
+				),
+			},
+		},
+	}
+	assert.NilError(t, server.StreamAccessLogs(stream))
+	assert.Assert(t, stream.closed)
+
+	edges := stats.Edges()
+	assert.Assert(t, is.Len(edges, 3))
+	assert.Equal(t, edges[0].Source, "alpha.svc")
+	assert.Equal(t, edges[0].Destination, "beta.svc")
+	assert.Equal(t, edges[0].Requests, uint64(2))
+	assert.Equal(t, edges[0].Errors, uint64(1))
+	assert.Equal(t, edges[0].ErrorRate, 0.5)
+	assert.Equal(t, edges[0].Latency["p50"], float64(10))
+	assert.Equal(t, edges[0].Latency["p99"], float64(30))
+	assert.Equal(t, edges[1].Destination, "gamma.svc")
+	assert.Equal(t, edges[2].Destination, unknownDestination)
+}
+
+func TestStatsMergeAndExpire(t *testing.T) {
+	now := time.Now()
+	stats := NewStats(time.Minute, "ingress")
+	stats.now = func() time.Time { return now }
+	// the tasks of a service are merged
+	stats.AddService("alpha.1", "alpha.svc")
+	stats.AddService("alpha.2", "alpha.svc")
+	stats.Record("alpha.1", "beta.svc", 200, 10)
+	stats.Record("alpha.2", "beta.svc", 503, 20)
+	stats.Record("ingress", "alpha.svc", 200, 5)
+	// nodes without known services share a source
+	stats.Record("task-1", "beta.svc", 200, 5)
+	stats.Record("task-2", "beta.svc", 200, 5)
+	edges := stats.Edges()
+	assert.Assert(t, is.Len(edges, 3))
+	assert.Equal(t, edges[0].Source, "alpha.svc")
+	assert.Equal(t, edges[0].Requests, uint64(2))
+	assert.Equal(t, edges[0].Errors, uint64(1))
+	assert.Equal(t, edges[1].Source, "ingress")
+	assert.Equal(t, edges[2].Source, unknownSource)
+	assert.Equal(t, edges[2].Requests, uint64(2))
+
+	// the counters don't drop when a node of the service goes away
+	now = now.Add(time.Second * 40)
+	stats.Record("alpha.1", "beta.svc", 200, 10)
+	now = now.Add(time.Second * 40)
+	stats.Record("alpha.1", "beta.svc", 200, 10)
+	edges = stats.Edges()
+	assert.Assert(t, is.Len(edges, 1))
+	assert.Equal(t, edges[0].Source, "alpha.svc")
+	assert.Equal(t, edges[0].Requests, uint64(4))
+
+	// stale nodes are forgotten
+	stats.Record("alpha.2", "beta.svc", 200, 10)
+	edges = stats.Edges()
+	assert.Assert(t, is.Len(edges, 2))
+	assert.Equal(t, edges[1].Source, unknownSource)
+	assert.Equal(t, edges[1].Requests, uint64(1))
+}
+
+func TestStatsPercentiles(t *testing.T) {
+	stats := NewStats(0, "ingress")
+	// outliers are evicted from the samples
+	for i := 0; i < 100; i++ {
+		stats.Record("ingress", "alpha.svc", 200, 1000)
+	}
+	for i := 1; i <= sampleSize; i++ {
+		stats.Record("ingress", "alpha.svc", 200, float64(i))
+	}
+	edges := stats.Edges()
+	assert.Equal(t, edges[0].Requests, uint64(sampleSize+100))
+	assert.Equal(t, edges[0].Latency["p50"], float64(512))
+	assert.Equal(t, edges[0].Latency["p90"], float64(922))
+	assert.Equal(t, edges[0].Latency["p99"], float64(1014))
+}
+
+func TestWritePrometheus(t *testing.T) {
+	stats := NewStats(0, "ingress")
+	stats.Record("ingress", "alpha.svc", 200, 12)
+	stats.Record("ingress", "alpha.svc", 0, 3)
+	var buf bytes.Buffer
+	stats.WritePrometheus(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`bent_edge_requests_total{source="ingress",destination="alpha.svc"} 2`,
+		`bent_edge_errors_total{source="ingress",destination="alpha.svc"} 1`,
+		`bent_edge_latency_milliseconds{source="ingress",destination="alpha.svc",quantile="0.5"} 3`,
+		`bent_edge_latency_milliseconds_sum{source="ingress",destination="alpha.svc"} 15`,
+		`bent_edge_latency_milliseconds_count{source="ingress",destination="alpha.svc"} 2`,
+	} {
+		assert.Assert(t, strings.Contains(out, line+"\n"), "missing %s in:\n%s", line, out)
+	}
+}
@@ -0,0 +1,262 @@
+package als
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sampleSize is the number of latencies per edge
+	// which are used to compute the percentiles
+	sampleSize = 1024
+)
+
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+type edgeKey struct {
+	source      string
+	destination string
+}
+
+type edge struct {
+	requests uint64
+	errors   uint64
+	// latencySum is the sum of all latencies in milliseconds
+	latencySum float64
+	// samples is a ring buffer of the latest latencies
+	samples []float64
+	next    int
+	// lastSeen is the time of the latest request
+	lastSeen time.Time
+}
+
+// nodeServices holds the services which are exposed by a node
+type nodeServices struct {
+	services map[string]struct{}
+	// lastSeen is the time of the latest request of the node
+	lastSeen time.Time
+}
+
+// Stats aggregates the requests per edge.
+// A request is recorded on the edge of the services which its node exposes,
+// the counters of an edge only grow until the whole edge expires
+type Stats struct {
+	mu    sync.Mutex
+	edges map[edgeKey]*edge
+	nodes map[string]*nodeServices
+	// gateways are reported by their node id
+	gateways map[string]struct{}
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+// NewStats returns empty stats.
+// Edges and nodes without requests for ttl are removed, 0 keeps them forever.
+// The requests of the gateway nodes are reported with the node id as source
+func NewStats(ttl time.Duration, gateways ...string) *Stats {
+	s := &Stats{
+		edges:    make(map[edgeKey]*edge),
+		nodes:    make(map[string]*nodeServices),
+		gateways: make(map[string]struct{}),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+	for _, gw := range gateways {
+		s.gateways[gw] = struct{}{}
+	}
+	return s
+}
+
+// AddService records that the node exposes the service
+func (s *Stats) AddService(id, service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodes[id]
+	if n == nil {
+		n = &nodeServices{services: make(map[string]struct{})}
+		s.nodes[id] = n
+	}
+	n.services[service] = struct{}{}
+	n.lastSeen = s.now()
+}
+
+// identity returns the sorted services of the node, the node id of gateways
+// or unknownSource if the node is not known to expose a service
+func (s *Stats) identity(id string) string {
+	if _, ok := s.gateways[id]; ok {
+		return id
+	}
+	n := s.nodes[id]
+	if n == nil || len(n.services) == 0 {
+		return unknownSource
+	}
+	var names []string
+	for name := range n.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Record adds a request from the source node to the destination
+// requests without response code or with a 5xx code are errors
+func (s *Stats) Record(source, destination string, code uint32, latencyMs float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if n := s.nodes[source]; n != nil {
+		n.lastSeen = now
+	}
+	key := edgeKey{s.identity(source), destination}
+	e := s.edges[key]
+	if e == nil {
+		e = &edge{}
+		s.edges[key] = e
+	}
+	e.lastSeen = now
+	e.requests++
+	if code == 0 || code >= 500 {
+		e.errors++
+	}
+	e.latencySum += latencyMs
+	if len(e.samples) < sampleSize {
+		e.samples = append(e.samples, latencyMs)
+		return
+	}
+	e.samples[e.next] = latencyMs
+	e.next = (e.next + 1) % sampleSize
+}
+
+// expire removes the edges and nodes without requests for ttl
+func (s *Stats) expire() {
+	if s.ttl == 0 {
+		return
+	}
+	now := s.now()
+	for key, e := range s.edges {
+		if now.Sub(e.lastSeen) > s.ttl {
+			delete(s.edges, key)
+		}
+	}
+	for id, n := range s.nodes {
+		if now.Sub(n.lastSeen) > s.ttl {
+			delete(s.nodes, id)
+		}
+	}
+}
+
+// EdgeStats contains the aggregated stats of an edge
+type EdgeStats struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Requests    uint64  `json:"requests"`
+	Errors      uint64  `json:"errors"`
+	ErrorRate   float64 `json:"errorRate"`
+	// LatencySum is the sum of all latencies in milliseconds
+	LatencySum float64 `json:"latencySum"`
+	// Latency contains the latency percentiles in milliseconds, e.g. p99
+	Latency map[string]float64 `json:"latency"`
+}
+
+// Edges returns the stats of all edges sorted by source and destination
+func (s *Stats) Edges() []EdgeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	var out []EdgeStats
+	for key, e := range s.edges {
+		samples := append([]float64(nil), e.samples...)
+		sort.Float64s(samples)
+		stats := EdgeStats{
+			Source:      key.source,
+			Destination: key.destination,
+			Requests:    e.requests,
+			Errors:      e.errors,
+			ErrorRate:   float64(e.errors) / float64(e.requests),
+			LatencySum:  e.latencySum,
+			Latency:     make(map[string]float64),
+		}
+		for _, q := range quantiles {
+			stats.Latency[quantileName(q)] = percentile(samples, q)
+		}
+		out = append(out, stats)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].Destination < out[j].Destination
+	})
+	return out
+}
+
+func quantileName(q float64) string {
+	return fmt.Sprintf("p%g", q*100)
+}
+
+// percentile uses the nearest-rank method, samples must be sorted
+func percentile(samples []float64, q float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	idx := int(q*float64(len(samples))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(samples) {
+		idx = len(samples) - 1
+	}
+	return samples[idx]
+}
+
+// WritePrometheus writes the edge stats in the prometheus text format
+func (s *Stats) WritePrometheus(w io.Writer) {
+	edges := s.Edges()
+	fmt.Fprintln(w, "# HELP bent_edge_requests_total Number of requests from a service to a service.")
+	fmt.Fprintln(w, "# TYPE bent_edge_requests_total counter")
+	for _, e := range edges {
+		fmt.Fprintf(w, "bent_edge_requests_total{%s} %d\n", labels(e), e.Requests)
+	}
+	fmt.Fprintln(w, "# HELP bent_edge_errors_total Number of failed requests from a service to a service.")
+	fmt.Fprintln(w, "# TYPE bent_edge_errors_total counter")
+	for _, e := range edges {
+		fmt.Fprintf(w, "bent_edge_errors_total{%s} %d\n", labels(e), e.Errors)
+	}
+	fmt.Fprintln(w, "# HELP bent_edge_latency_milliseconds Latency of the requests from a service to a service.")
+	fmt.Fprintln(w, "# TYPE bent_edge_latency_milliseconds summary")
+	for _, e := range edges {
+		for _, q := range quantiles {
+			fmt.Fprintf(w, "bent_edge_latency_milliseconds{%s,quantile=\"%g\"} %g\n", labels(e), q, e.Latency[quantileName(q)])
+		}
+		fmt.Fprintf(w, "bent_edge_latency_milliseconds_sum{%s} %g\n", labels(e), e.LatencySum)
+		fmt.Fprintf(w, "bent_edge_latency_milliseconds_count{%s} %d\n", labels(e), e.Requests)
+	}
+}
+
+func labels(e EdgeStats) string {
+	return fmt.Sprintf("source=%q,destination=%q", e.Source, e.Destination)
+}
+
+// MetricsHandler serves the edge stats in the prometheus text format
+func (s *Stats) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WritePrometheus(w)
+}
+
+// GraphHandler serves the edge stats as JSON
+func (s *Stats) GraphHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	edges := s.Edges()
+	if edges == nil {
+		edges = []EdgeStats{}
+	}
+	json.NewEncoder(w).Encode(struct {
+		Edges []EdgeStats `json:"edges"`
+	}{edges})
+}
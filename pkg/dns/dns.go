@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTTL      = 10 // in seconds
+	maxMessageSize  = 4096
+	upstreamTimeout = time.Second * 2
+)
+
+// Server answers the A queries of mesh service names with the address of the sidecar
+// all other queries are forwarded to the upstream server
+type Server struct {
+	mu       sync.RWMutex
+	names    map[string]struct{}
+	address  [4]byte
+	upstream string
+}
+
+// NewServer returns a new Server
+// the address must be an IPv4 address, e.g. the loopback address of the sidecar
+func NewServer(address net.IP, upstream string) *Server {
+	s := &Server{
+		names:    make(map[string]struct{}),
+		upstream: upstream,
+	}
+	copy(s.address[:], address.To4())
+	return s
+}
+
+// SetNames replaces the names which are answered locally
+func (s *Server) SetNames(names []string) {
+	m := make(map[string]struct{})
+	for _, name := range names {
+		m[normalize(name)] = struct{}{}
+	}
+	s.mu.Lock()
+	s.names = m
+	s.mu.Unlock()
+}
+
+func (s *Server) known(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.names[normalize(name)]
+	return ok
+}
+
+// normalize strips the trailing dot and lowercases the name
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Serve answers the queries on the packet conn until it is closed
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			res, err := s.Resolve(query)
+			if err != nil {
+				log.Warnf("error resolving query of %s: %s", addr, err)
+				return
+			}
+			if _, err := conn.WriteTo(res, addr); err != nil {
+				log.Warnf("error answering %s: %s", addr, err)
+			}
+		}()
+	}
+}
+
+// Resolve returns the response to the query
+// queries which contain a mesh service name are answered locally
+func (s *Server) Resolve(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(msg.Questions) != 1 || !s.known(msg.Questions[0].Name.String()) {
+		return s.forward(query)
+	}
+	q := msg.Questions[0]
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: msg.Questions,
+	}
+	// other types are answered without records
+	if q.Type == dnsmessage.TypeA {
+		res.Answers = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   defaultTTL,
+				},
+				Body: &dnsmessage.AResource{A: s.address},
+			},
+		}
+	}
+	return res.Pack()
+}
+
+// forward sends the query to the upstream server and returns its response
+func (s *Server) forward(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", s.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
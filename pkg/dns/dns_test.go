@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// startUpstream starts a stub upstream server
+// which answers all queries with NXDOMAIN
+func startUpstream(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			msg.Response = true
+			msg.RCode = dnsmessage.RCodeNameError
+			res, _ := msg.Pack()
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn
+}
+
+func query(t *testing.T, addr net.Addr, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	conn, err := net.Dial("udp", addr.String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	buf, err := q.Pack()
+	assert.NilError(t, err)
+	_, err = conn.Write(buf)
+	assert.NilError(t, err)
+	buf = make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	assert.NilError(t, err)
+	var res dnsmessage.Message
+	assert.NilError(t, res.Unpack(buf[:n]))
+	assert.Equal(t, res.ID, uint16(42))
+	return res
+}
+
+func TestServer(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	server := NewServer(net.ParseIP("127.0.0.1"), upstream.LocalAddr().String())
+	server.SetNames([]string{"beta.svc", "Gamma.svc"})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer conn.Close()
+	go server.Serve(conn)
+
+	res := query(t, conn.LocalAddr(), "beta.svc.", dnsmessage.TypeA)
+	assert.Equal(t, res.RCode, dnsmessage.RCodeSuccess)
+	assert.Assert(t, is.Len(res.Answers, 1))
+	assert.Equal(t, res.Answers[0].Body.(*dnsmessage.AResource).A, [4]byte{127, 0, 0, 1})
+
+	// names are case-insensitive
+	res = query(t, conn.LocalAddr(), "gamma.SVC.", dnsmessage.TypeA)
+	assert.Assert(t, is.Len(res.Answers, 1))
+
+	// no IPv6 address
+	res = query(t, conn.LocalAddr(), "beta.svc.", dnsmessage.TypeAAAA)
+	assert.Equal(t, res.RCode, dnsmessage.RCodeSuccess)
+	assert.Assert(t, is.Len(res.Answers, 0))
+
+	// unknown names are forwarded
+	res = query(t, conn.LocalAddr(), "example.com.", dnsmessage.TypeA)
+	assert.Equal(t, res.RCode, dnsmessage.RCodeNameError)
+
+	server.SetNames(nil)
+	res = query(t, conn.LocalAddr(), "beta.svc.", dnsmessage.TypeA)
+	assert.Equal(t, res.RCode, dnsmessage.RCodeNameError)
+}
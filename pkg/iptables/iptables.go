@@ -0,0 +1,41 @@
+package iptables
+
+import (
+	"fmt"
+)
+
+const chain = "BENT_OUTPUT"
+
+// Config defines which outbound connections are redirected to envoy
+type Config struct {
+	// ProxyPort specifies the port of the catch-all listener
+	ProxyPort uint32
+	// ProxyUID specifies the user id of the envoy process
+	// its connections are never redirected
+	ProxyUID uint32
+	// ExcludePorts specifies destination ports which are not redirected
+	ExcludePorts []uint32
+	// ExcludeCIDRs specifies destination ranges which are not redirected
+	ExcludeCIDRs []string
+}
+
+// Rules returns the iptables commands which redirect the outbound
+// tcp connections of the apps to envoy
+// the connections of envoy itself and to localhost are never redirected
+func Rules(cfg Config) []string {
+	rules := []string{
+		fmt.Sprintf("iptables -t nat -N %s", chain),
+		fmt.Sprintf("iptables -t nat -A %s -m owner --uid-owner %d -j RETURN", chain, cfg.ProxyUID),
+		fmt.Sprintf("iptables -t nat -A %s -d 127.0.0.1/32 -j RETURN", chain),
+	}
+	for _, cidr := range cfg.ExcludeCIDRs {
+		rules = append(rules, fmt.Sprintf("iptables -t nat -A %s -d %s -j RETURN", chain, cidr))
+	}
+	for _, port := range cfg.ExcludePorts {
+		rules = append(rules, fmt.Sprintf("iptables -t nat -A %s -p tcp --dport %d -j RETURN", chain, port))
+	}
+	return append(rules,
+		fmt.Sprintf("iptables -t nat -A %s -p tcp -j REDIRECT --to-ports %d", chain, cfg.ProxyPort),
+		fmt.Sprintf("iptables -t nat -A OUTPUT -p tcp -j %s", chain),
+	)
+}
@@ -0,0 +1,25 @@
+package iptables
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRules(t *testing.T) {
+	rules := Rules(Config{
+		ProxyPort:    15001,
+		ProxyUID:     1337,
+		ExcludePorts: []uint32{22},
+		ExcludeCIDRs: []string{"169.254.0.0/16"},
+	})
+	assert.DeepEqual(t, rules, []string{
+		"iptables -t nat -N BENT_OUTPUT",
+		"iptables -t nat -A BENT_OUTPUT -m owner --uid-owner 1337 -j RETURN",
+		"iptables -t nat -A BENT_OUTPUT -d 127.0.0.1/32 -j RETURN",
+		"iptables -t nat -A BENT_OUTPUT -d 169.254.0.0/16 -j RETURN",
+		"iptables -t nat -A BENT_OUTPUT -p tcp --dport 22 -j RETURN",
+		"iptables -t nat -A BENT_OUTPUT -p tcp -j REDIRECT --to-ports 15001",
+		"iptables -t nat -A OUTPUT -p tcp -j BENT_OUTPUT",
+	})
+}
@@ -0,0 +1,270 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	google_protobuf "github.com/gogo/protobuf/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/moolen/bent/envoy/api/v2/core"
+	accesslog "github.com/moolen/bent/envoy/config/accesslog/v2"
+	v21 "github.com/moolen/bent/envoy/config/filter/accesslog/v2"
+	_type "github.com/moolen/bent/envoy/type"
+	"github.com/moolen/bent/pkg/util"
+)
+
+const (
+	accessLogSinkFile = "file"
+	accessLogSinkGRPC = "grpc"
+
+	accessLogFormatJSON = "json"
+	accessLogFormatText = "text"
+
+	accessLogStdout = "stdout"
+
+	defaultAccessLogPath    = "/tmp/access.log"
+	defaultAccessLogCluster = "als"
+)
+
+// AccessLogConfig defines the access logging of the listeners of a node
+// the zero value writes JSON logs to /tmp/access.log
+type AccessLogConfig struct {
+	// Disabled turns off access logging
+	Disabled bool `yaml:"disabled"`
+	// Sink is either file or grpc, defaults to file
+	Sink string `yaml:"sink"`
+	// Path specifies the file of the file sink, defaults to /tmp/access.log
+	// use stdout to write to the standard output of envoy
+	Path string `yaml:"path"`
+	// Format is either json or text, defaults to json
+	Format string `yaml:"format"`
+	// Template specifies the text format, defaults to the envoy default format
+	Template string `yaml:"template"`
+	// Fields are added to the JSON log, they override the default fields.
+	// An empty value removes a default field
+	Fields map[string]string `yaml:"fields"`
+	// MinStatus only logs responses with a status code >= MinStatus
+	MinStatus uint32 `yaml:"minStatus"`
+	// SamplePercent only logs the given percentage of requests
+	// 0 disables sampling
+	SamplePercent uint32 `yaml:"samplePercent"`
+	// Cluster specifies the cluster of the gRPC access log service
+	// it must be defined in the envoy bootstrap config, defaults to als
+	Cluster string `yaml:"cluster"`
+	// LogName identifies the log stream of the gRPC sink
+	// defaults to the name of the route config of the listener
+	LogName string `yaml:"logName"`
+}
+
+// accessLog returns the access log config of a node
+// the node config takes precedence over the mesh config
+// invalid configs fall back to the default
+func (m MeshConfig) accessLog(node NodeConfig) AccessLogConfig {
+	cfg := m.AccessLog
+	if node.AccessLog != nil {
+		cfg = node.AccessLog
+	}
+	if cfg == nil {
+		return AccessLogConfig{}
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Warnf("invalid access log config: %s", err)
+		return AccessLogConfig{}
+	}
+	return *cfg
+}
+
+func createAccessLogs(cfg AccessLogConfig, logName string) []*v21.AccessLog {
+	if cfg.Disabled {
+		return nil
+	}
+	entry := &v21.AccessLog{
+		Name:   util.FileAccessLog,
+		Filter: createAccessLogFilter(cfg),
+	}
+	if cfg.Sink == accessLogSinkGRPC {
+		if cfg.LogName != "" {
+			logName = cfg.LogName
+		}
+		cluster := cfg.Cluster
+		if cluster == "" {
+			cluster = defaultAccessLogCluster
+		}
+		entry.Name = util.HTTPGRPCAccessLog
+		entry.ConfigType = &v21.AccessLog_TypedConfig{
+			TypedConfig: util.MessageToAny(&accesslog.HttpGrpcAccessLogConfig{
+				CommonConfig: &accesslog.CommonGrpcAccessLogConfig{
+					LogName: logName,
+					GrpcService: &core.GrpcService{
+						TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+							EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+								ClusterName: cluster,
+							},
+						},
+					},
+				},
+			}),
+		}
+		return []*v21.AccessLog{entry}
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultAccessLogPath
+	} else if path == accessLogStdout {
+		path = "/dev/stdout"
+	}
+	fileLog := &accesslog.FileAccessLog{
+		Path: path,
+		AccessLogFormat: &accesslog.FileAccessLog_JsonFormat{
+			JsonFormat: createJSONLogFormat(cfg.Fields),
+		},
+	}
+	if cfg.Format == accessLogFormatText {
+		fileLog.AccessLogFormat = &accesslog.FileAccessLog_Format{
+			Format: cfg.Template,
+		}
+	}
+	entry.ConfigType = &v21.AccessLog_TypedConfig{
+		TypedConfig: util.MessageToAny(fileLog),
+	}
+	return []*v21.AccessLog{entry}
+}
+
+// createJSONLogFormat merges the custom fields into the default fields
+func createJSONLogFormat(fields map[string]string) *google_protobuf.Struct {
+	if len(fields) == 0 {
+		return jsonLog
+	}
+	format := &google_protobuf.Struct{
+		Fields: make(map[string]*google_protobuf.Value),
+	}
+	for key, val := range jsonLog.Fields {
+		format.Fields[key] = val
+	}
+	for key, val := range fields {
+		if val == "" {
+			delete(format.Fields, key)
+			continue
+		}
+		format.Fields[key] = &google_protobuf.Value{
+			Kind: &google_protobuf.Value_StringValue{StringValue: val},
+		}
+	}
+	return format
+}
+
+// createAccessLogFilter returns nil if all requests should be logged
+func createAccessLogFilter(cfg AccessLogConfig) *v21.AccessLogFilter {
+	var filters []*v21.AccessLogFilter
+	if cfg.MinStatus > 0 {
+		filters = append(filters, &v21.AccessLogFilter{
+			FilterSpecifier: &v21.AccessLogFilter_StatusCodeFilter{
+				StatusCodeFilter: &v21.StatusCodeFilter{
+					Comparison: &v21.ComparisonFilter{
+						Op: v21.ComparisonFilter_GE,
+						Value: &core.RuntimeUInt32{
+							DefaultValue: cfg.MinStatus,
+							RuntimeKey:   "access_log.min_status",
+						},
+					},
+				},
+			},
+		})
+	}
+	if cfg.SamplePercent > 0 && cfg.SamplePercent < 100 {
+		filters = append(filters, &v21.AccessLogFilter{
+			FilterSpecifier: &v21.AccessLogFilter_RuntimeFilter{
+				RuntimeFilter: &v21.RuntimeFilter{
+					RuntimeKey: "access_log.sample_percent",
+					PercentSampled: &_type.FractionalPercent{
+						Numerator:   cfg.SamplePercent,
+						Denominator: _type.FractionalPercent_HUNDRED,
+					},
+				},
+			},
+		})
+	}
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return &v21.AccessLogFilter{
+		FilterSpecifier: &v21.AccessLogFilter_AndFilter{
+			AndFilter: &v21.AndFilter{
+				Filters: filters,
+			},
+		},
+	}
+}
+
+// ParseAccessLogConfig parses the access log config from a flat map
+// e.g. sink: grpc, fields.user_agent: %REQ(USER-AGENT)%
+func ParseAccessLogConfig(in map[string]string) (*AccessLogConfig, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	cfg := &AccessLogConfig{}
+	for key, val := range in {
+		var err error
+		switch key {
+		case "disabled":
+			cfg.Disabled = true
+		case "sink":
+			cfg.Sink = val
+		case "path":
+			cfg.Path = val
+		case "format":
+			cfg.Format = val
+		case "template":
+			cfg.Template = val
+		case "min-status":
+			cfg.MinStatus, err = parseUInt32(val)
+		case "sample-percent":
+			cfg.SamplePercent, err = parseUInt32(val)
+		case "cluster":
+			cfg.Cluster = val
+		case "log-name":
+			cfg.LogName = val
+		default:
+			field := strings.TrimPrefix(key, "fields.")
+			if field == key {
+				return nil, fmt.Errorf("unknown field %s", key)
+			}
+			if cfg.Fields == nil {
+				cfg.Fields = make(map[string]string)
+			}
+			cfg.Fields[field] = val
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %s", key, err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate returns an error if the config is invalid
+func (c AccessLogConfig) Validate() error {
+	if c.Sink != "" && c.Sink != accessLogSinkFile && c.Sink != accessLogSinkGRPC {
+		return fmt.Errorf("invalid sink: %s", c.Sink)
+	}
+	if c.Format != "" && c.Format != accessLogFormatJSON && c.Format != accessLogFormatText {
+		return fmt.Errorf("invalid format: %s", c.Format)
+	}
+	if c.SamplePercent > 100 {
+		return fmt.Errorf("invalid sample percent: %d", c.SamplePercent)
+	}
+	return nil
+}
+
+func parseUInt32(val string) (uint32, error) {
+	num, err := strconv.ParseUint(val, 10, 32)
+	return uint32(num), err
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/types"
+	accesslog "github.com/moolen/bent/envoy/config/accesslog/v2"
+	v21 "github.com/moolen/bent/envoy/config/filter/accesslog/v2"
+	"github.com/moolen/bent/pkg/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCreateAccessLogs(t *testing.T) {
+	// defaults
+	logs := createAccessLogs(AccessLogConfig{}, ingressRoute)
+	assert.Assert(t, is.Len(logs, 1))
+	assert.Equal(t, logs[0].Name, util.FileAccessLog)
+	assert.Assert(t, logs[0].Filter == nil)
+	var fileLog accesslog.FileAccessLog
+	assert.NilError(t, types.UnmarshalAny(logs[0].ConfigType.(*v21.AccessLog_TypedConfig).TypedConfig, &fileLog))
+	assert.Equal(t, fileLog.Path, defaultAccessLogPath)
+	assert.Equal(t, len(fileLog.GetJsonFormat().Fields), len(jsonLog.Fields))
+
+	// custom fields & filters
+	logs = createAccessLogs(AccessLogConfig{
+		Path:          accessLogStdout,
+		Fields:        map[string]string{"user_agent": "", "tenant": "%REQ(X-TENANT)%"},
+		MinStatus:     500,
+		SamplePercent: 10,
+	}, ingressRoute)
+	assert.NilError(t, types.UnmarshalAny(logs[0].ConfigType.(*v21.AccessLog_TypedConfig).TypedConfig, &fileLog))
+	assert.Equal(t, fileLog.Path, "/dev/stdout")
+	fields := fileLog.GetJsonFormat().Fields
+	assert.Assert(t, fields["user_agent"] == nil)
+	assert.Equal(t, fields["tenant"].GetStringValue(), "%REQ(X-TENANT)%")
+	assert.Assert(t, jsonLog.Fields["user_agent"] != nil)
+	filters := logs[0].Filter.GetAndFilter().Filters
+	assert.Assert(t, is.Len(filters, 2))
+	assert.Equal(t, filters[0].GetStatusCodeFilter().Comparison.Value.DefaultValue, uint32(500))
+	assert.Equal(t, filters[1].GetRuntimeFilter().PercentSampled.Numerator, uint32(10))
+
+	// grpc sink
+	logs = createAccessLogs(AccessLogConfig{Sink: accessLogSinkGRPC}, egressRoute)
+	assert.Equal(t, logs[0].Name, util.HTTPGRPCAccessLog)
+	var grpcLog accesslog.HttpGrpcAccessLogConfig
+	assert.NilError(t, types.UnmarshalAny(logs[0].ConfigType.(*v21.AccessLog_TypedConfig).TypedConfig, &grpcLog))
+	assert.Equal(t, grpcLog.CommonConfig.LogName, egressRoute)
+	assert.Equal(t, grpcLog.CommonConfig.GrpcService.GetEnvoyGrpc().ClusterName, defaultAccessLogCluster)
+
+	assert.Assert(t, is.Len(createAccessLogs(AccessLogConfig{Disabled: true}, egressRoute), 0))
+}
+
+func TestParseAccessLogConfig(t *testing.T) {
+	cfg, err := ParseAccessLogConfig(map[string]string{
+		"sink":              "file",
+		"format":            "text",
+		"template":          "%START_TIME% %RESPONSE_CODE%\n",
+		"min-status":        "400",
+		"fields.request_id": "",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cfg, &AccessLogConfig{
+		Sink:      accessLogSinkFile,
+		Format:    accessLogFormatText,
+		Template:  "%START_TIME% %RESPONSE_CODE%\n",
+		MinStatus: 400,
+		Fields:    map[string]string{"request_id": ""},
+	})
+
+	cfg, err = ParseAccessLogConfig(nil)
+	assert.NilError(t, err)
+	assert.Assert(t, cfg == nil)
+
+	_, err = ParseAccessLogConfig(map[string]string{"sink": "kafka"})
+	assert.ErrorContains(t, err, "invalid sink")
+	_, err = ParseAccessLogConfig(map[string]string{"sample-percent": "x"})
+	assert.ErrorContains(t, err, "invalid value")
+	_, err = ParseAccessLogConfig(map[string]string{"foo": "bar"})
+	assert.ErrorContains(t, err, "unknown field")
+}
@@ -0,0 +1,447 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// annotationType specifies how the value of an annotation is validated
+type annotationType int
+
+const (
+	annotationString annotationType = iota
+	// annotationFlag is enabled by an empty value or true, false disables it
+	annotationFlag
+	annotationUInt32
+	annotationPercent
+	// annotationDuration is specified in milliseconds
+	annotationDuration
+	annotationEnum
+	annotationList
+	annotationKeyValueList
+	annotationHex
+	annotationHexList
+	annotationStatusRange
+	annotationVersionWeights
+	annotationSamplingPercent
+	annotationTracingTags
+)
+
+const (
+	levelCluster  = "cluster"
+	levelEndpoint = "endpoint"
+	levelListener = "listener"
+)
+
+// AnnotationSpec documents and validates an annotation
+type AnnotationSpec struct {
+	Key   string
+	Level string
+	Type  annotationType
+	// Default documents the value which is used if the annotation is missing
+	Default string
+	// Min and Max limit the value of uint32 and duration annotations, Max 0 means no limit
+	Min uint32
+	Max uint32
+	// Values specifies the valid values of enum annotations
+	Values      []string
+	Description string
+}
+
+// annotationRegistry contains all annotations, ordered by the reference table
+var annotationRegistry = []AnnotationSpec{
+	{Key: AnnotationProtocol, Level: levelCluster, Type: annotationEnum, Default: protocolHTTP1, Values: []string{protocolHTTP, protocolHTTP1, protocolHTTP2, protocolGRPC, protocolTCP}, Description: "protocol of the service, http is an alias of http1"},
+	{Key: AnnotationGRPCRetryOn, Level: levelCluster, Type: annotationList, Default: defaultGRPCRetryOn, Description: "gRPC status codes which are retried, empty disables retries"},
+	{Key: AnnotationGRPCNumRetries, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultGRPCRetries), Description: "number of retries of gRPC requests"},
+	{Key: AnnotationTCPEgressPort, Level: levelCluster, Type: annotationUInt32, Min: 1, Max: 65535, Description: "port of the consumer sidecars which accepts connections to a tcp service, required for tcp services"},
+	{Key: AnnotationTCPIngressPort, Level: levelCluster, Type: annotationUInt32, Default: "egress port + 100", Min: 1, Max: 65535, Description: "port of the sidecars which expose a tcp service"},
+
+	{Key: AnnotationHealthDisabled, Level: levelCluster, Type: annotationFlag, Description: "disables active health checking"},
+	{Key: AnnotationHealthType, Level: levelCluster, Type: annotationEnum, Default: "http, tcp for tcp services, grpc for grpc services", Values: []string{healthCheckHTTP, healthCheckTCP, healthCheckGRPC}, Description: "health checker"},
+	{Key: AnnotationHealthCheckPath, Level: levelCluster, Type: annotationString, Default: defaultHealthCheckPath, Description: "path of HTTP health checks"},
+	{Key: AnnotationHealthPort, Level: levelCluster, Type: annotationUInt32, Default: "port of the endpoint", Min: 1, Max: 65535, Description: "port of the health checks"},
+	{Key: AnnotationHealthHost, Level: levelCluster, Type: annotationString, Description: "host header of HTTP health checks"},
+	{Key: AnnotationHealthHeaders, Level: levelCluster, Type: annotationKeyValueList, Description: "headers of HTTP health checks"},
+	{Key: AnnotationHealthExpectedStatus, Level: levelCluster, Type: annotationStatusRange, Default: fmt.Sprintf("%d-%d", defaultHealthExpectedStatusLower, defaultHealthExpectedStatusUpper), Description: "accepted status codes of HTTP health checks, the upper bound is exclusive"},
+	{Key: AnnotationHealthTCPSend, Level: levelCluster, Type: annotationHex, Description: "payload of tcp health checks, without payload only the connection is checked"},
+	{Key: AnnotationHealthTCPReceive, Level: levelCluster, Type: annotationHexList, Description: "payloads which must be contained in the response of tcp health checks"},
+	{Key: AnnotationHealthGRPCService, Level: levelCluster, Type: annotationString, Description: "service name of gRPC health checks"},
+	{Key: AnnotationHealthTimeout, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultHealthTimeout), Min: 1, Description: "timeout of a health check"},
+	{Key: AnnotationHealthInterval, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultHealthInterval), Min: 1, Description: "health check interval"},
+	{Key: AnnotationHealthIntervalJitter, Level: levelCluster, Type: annotationDuration, Description: "random jitter which is added to the interval"},
+	{Key: AnnotationHealthNoTrafficInterval, Level: levelCluster, Type: annotationDuration, Description: "interval which is used while the cluster does not receive traffic"},
+	{Key: AnnotationHealthHealthyThreshold, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultHealthThreshold), Min: 1, Description: "number of successful checks until a host is marked healthy"},
+	{Key: AnnotationHealthUnhealthyThreshold, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultHealthThreshold), Min: 1, Description: "number of failed checks until a host is marked unhealthy"},
+	{Key: AnnotationHealthRespond, Level: levelCluster, Type: annotationFlag, Description: "the sidecar answers the health checks of peers instead of passing them through"},
+	{Key: AnnotationHealthMinHealthyPercent, Level: levelCluster, Type: annotationPercent, Default: strconv.Itoa(defaultHealthMinHealthyPercent), Description: "percentage of healthy local endpoints which is required to respond with a healthy status"},
+	{Key: AnnotationHealthCacheDuration, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultHealthCacheDuration), Description: "duration for which passed through health checks are cached"},
+
+	{Key: AnnotaionCBMaxConn, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultCBMaxConnections), Min: 1, Description: "maximum number of connections to the upstream"},
+	{Key: AnnotaionCBMaxPending, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultCBMaxPendingRequests), Min: 1, Description: "maximum number of pending requests to the upstream"},
+	{Key: AnnotaionCBMaxRequests, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultCBMaxRequests), Min: 1, Description: "maximum number of parallel requests"},
+	{Key: AnnotaionCBMaxRetries, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultCBMaxRetries), Min: 1, Description: "maximum number of parallel retries"},
+
+	{Key: AnnotationTimeoutRequest, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultRequestTimeout) + ", none for grpc services", Description: "request timeout of the route, 0 disables the timeout"},
+	{Key: AnnotationTimeoutIdle, Level: levelCluster, Type: annotationDuration, Min: 1, Description: "stream idle timeout of the route"},
+	{Key: AnnotationTimeoutConnect, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultConnectTimeout), Min: 1, Description: "connect timeout of the cluster"},
+	{Key: AnnotationTimeoutMaxStreamDuration, Level: levelCluster, Type: annotationDuration, Min: 1, Description: "upper bound of the grpc-timeout of streaming requests"},
+
+	{Key: AnnotationOutlierDisabled, Level: levelCluster, Type: annotationFlag, Description: "disables outlier detection"},
+	{Key: AnnotationOutlierConsecutive5xx, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultOutlierConsecutive5xx), Min: 1, Description: "number of consecutive 5xx responses before a host is ejected"},
+	{Key: AnnotationOutlierConsecutiveGatewayErrors, Level: levelCluster, Type: annotationUInt32, Default: "0 (disabled)", Description: "number of consecutive gateway errors (502, 503, 504) before a host is ejected"},
+	{Key: AnnotationOutlierInterval, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultOutlierInterval), Min: 1, Description: "ejection analysis interval"},
+	{Key: AnnotationOutlierBaseEjectionTime, Level: levelCluster, Type: annotationDuration, Default: strconv.Itoa(defaultOutlierBaseEjectionTime), Min: 1, Description: "base ejection time"},
+	{Key: AnnotationOutlierMaxEjectionPercent, Level: levelCluster, Type: annotationPercent, Default: strconv.Itoa(defaultOutlierMaxEjectionPercent), Description: "maximum percentage of hosts that can be ejected"},
+	{Key: AnnotationOutlierSuccessRateEnforcing, Level: levelCluster, Type: annotationPercent, Default: strconv.Itoa(defaultOutlierSuccessRateEnforcing), Description: "chance that a host is ejected because of its success rate, 0 disables success rate ejection"},
+	{Key: AnnotationOutlierSuccessRateMinHosts, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultOutlierSuccessRateMinHosts), Min: 1, Description: "number of hosts with enough request volume to run the success rate analysis"},
+	{Key: AnnotationOutlierSuccessRateRequestVolume, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultOutlierSuccessRateRequestVolume), Min: 1, Description: "minimum number of requests of a host within an interval to be included in the success rate analysis"},
+	{Key: AnnotationOutlierSuccessRateStdevFactor, Level: levelCluster, Type: annotationUInt32, Default: strconv.Itoa(defaultOutlierSuccessRateStdevFactor), Min: 1, Description: "ejection threshold factor (divided by 1000) of the success rate standard deviation"},
+
+	{Key: AnnotationLBPolicy, Level: levelCluster, Type: annotationEnum, Default: lbPolicyRoundRobin, Values: []string{lbPolicyRoundRobin, lbPolicyLeastRequest, lbPolicyRandom, lbPolicyRingHash, lbPolicyMaglev}, Description: "load balancing policy"},
+	{Key: AnnotationLBHashHeader, Level: levelCluster, Type: annotationString, Description: "request header which is hashed by ring-hash and maglev"},
+	{Key: AnnotationLBHashCookie, Level: levelCluster, Type: annotationString, Description: "cookie which is hashed by ring-hash and maglev, it is generated if missing"},
+	{Key: AnnotationLBHashCookieTTL, Level: levelCluster, Type: annotationDuration, Default: "session cookie", Description: "TTL of the generated cookie"},
+	{Key: AnnotationLBHashSourceIP, Level: levelCluster, Type: annotationFlag, Description: "hashes the source ip"},
+
+	{Key: AnnotationTrafficSplit, Level: levelCluster, Type: annotationVersionWeights, Description: "splits the traffic between versions, e.g. v1=90,v2=10"},
+	{Key: AnnotationMirrorService, Level: levelCluster, Type: annotationString, Description: "service which receives a copy of the requests"},
+	{Key: AnnotationMirrorPercent, Level: levelCluster, Type: annotationPercent, Default: strconv.Itoa(defaultMirrorPercent), Description: "percentage of requests which are mirrored"},
+
+	{Key: AnnotationAuthzEnabled, Level: levelCluster, Type: annotationFlag, Description: "enables external authorization on the ingress listener, requires a mesh authz config"},
+	{Key: AnnotationAuthzDisabledPaths, Level: levelCluster, Type: annotationList, Description: "path prefixes which are not subject to authorization"},
+
+	{Key: AnnotationTracingClientSampling, Level: levelCluster, Type: annotationSamplingPercent, Default: "mesh config", Description: "percentage of requests with x-client-trace-id which are traced"},
+	{Key: AnnotationTracingRandomSampling, Level: levelCluster, Type: annotationSamplingPercent, Default: "mesh config", Description: "percentage of requests which are randomly traced"},
+	{Key: AnnotationTracingOverallSampling, Level: levelCluster, Type: annotationSamplingPercent, Default: "mesh config", Description: "upper limit of the percentage of traced requests"},
+	{Key: AnnotationTracingTags, Level: levelCluster, Type: annotationTracingTags, Description: "request headers which are added to the spans as tags"},
+
+	{Key: AnnotaionEndpointWeight, Level: levelEndpoint, Type: annotationUInt32, Default: strconv.Itoa(defaultEndpointWeight), Min: 1, Max: 128, Description: "load balancing weight of the endpoint"},
+	{Key: AnnotationEndpointVersion, Level: levelEndpoint, Type: annotationString, Description: "version of the service the endpoint belongs to"},
+
+	{Key: AnnotaionFaultInject, Level: levelListener, Type: annotationFlag, Description: "enables fault injection"},
+	{Key: AnnotaionFaultDelayPercent, Level: levelListener, Type: annotationPercent, Default: "0", Description: "percentage of delayed requests"},
+	{Key: AnnotaionFaultDelayDuration, Level: levelListener, Type: annotationDuration, Default: strconv.Itoa(defaultFaultDelayDuration), Description: "injected delay"},
+	{Key: AnnotaionFaultAbortPercent, Level: levelListener, Type: annotationPercent, Default: "0", Description: "percentage of aborted requests"},
+	{Key: AnnotaionFaultAbortCode, Level: levelListener, Type: annotationUInt32, Default: strconv.Itoa(defaultFaultAbortCode), Min: 200, Max: 599, Description: "status code of aborted requests"},
+}
+
+// lookupAnnotation returns nil if the annotation is unknown
+func lookupAnnotation(key string) *AnnotationSpec {
+	for i := range annotationRegistry {
+		if annotationRegistry[i].Key == key {
+			return &annotationRegistry[i]
+		}
+	}
+	return nil
+}
+
+// annotationInRange returns true if the number is within the bounds of the annotation
+func annotationInRange(key string, num int) bool {
+	spec := lookupAnnotation(key)
+	if spec == nil {
+		return true
+	}
+	return num >= int(spec.Min) && (spec.Max == 0 || num <= int(spec.Max))
+}
+
+// Validate returns an error if the value is invalid
+func (s AnnotationSpec) Validate(val string) error {
+	switch s.Type {
+	case annotationFlag:
+		if _, err := strconv.ParseBool(val); val != "" && err != nil {
+			return fmt.Errorf("must be empty, true or false")
+		}
+	case annotationUInt32, annotationDuration:
+		num, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return fmt.Errorf("must be a positive number")
+		}
+		if uint32(num) < s.Min || (s.Max > 0 && uint32(num) > s.Max) {
+			return fmt.Errorf("must be within %s", s.bounds())
+		}
+	case annotationPercent:
+		num, err := strconv.ParseUint(val, 10, 32)
+		if err != nil || num > 100 {
+			return fmt.Errorf("must be a percentage between 0 and 100")
+		}
+	case annotationSamplingPercent:
+		num, err := strconv.ParseFloat(val, 64)
+		if err != nil || num < 0 || num > 100 {
+			return fmt.Errorf("must be a percentage between 0 and 100")
+		}
+	case annotationEnum:
+		for _, v := range s.Values {
+			if v == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(s.Values, ", "))
+	case annotationKeyValueList:
+		for _, pair := range splitList(val) {
+			if !strings.Contains(pair, "=") {
+				return fmt.Errorf("invalid key=value pair %s", pair)
+			}
+		}
+	case annotationHex:
+		if _, err := hex.DecodeString(val); err != nil {
+			return fmt.Errorf("must be hex encoded")
+		}
+	case annotationHexList:
+		for _, item := range splitList(val) {
+			if _, err := hex.DecodeString(item); err != nil {
+				return fmt.Errorf("%s must be hex encoded", item)
+			}
+		}
+	case annotationStatusRange:
+		lower, upper, err := parseInt64Range(val)
+		if err != nil {
+			return err
+		}
+		if lower < 100 || upper > 600 || lower >= upper {
+			return fmt.Errorf("must be a range of status codes, e.g. 200-400")
+		}
+	case annotationVersionWeights:
+		if _, err := parseVersionWeights(val); err != nil {
+			return err
+		}
+	case annotationTracingTags:
+		for _, header := range splitList(val) {
+			if err := validateTracingTag(header); err != nil {
+				return fmt.Errorf("invalid tracing tag %s: %s", header, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s AnnotationSpec) bounds() string {
+	if s.Max == 0 {
+		return fmt.Sprintf("%d and more", s.Min)
+	}
+	return fmt.Sprintf("%d-%d", s.Min, s.Max)
+}
+
+// typeName describes the type in the reference table
+func (s AnnotationSpec) typeName() string {
+	switch s.Type {
+	case annotationFlag:
+		return "flag"
+	case annotationUInt32:
+		if s.Min > 0 || s.Max > 0 {
+			return fmt.Sprintf("number (%s)", s.bounds())
+		}
+		return "number"
+	case annotationPercent:
+		return "percent (0-100)"
+	case annotationDuration:
+		if s.Min > 0 || s.Max > 0 {
+			return fmt.Sprintf("milliseconds (%s)", s.bounds())
+		}
+		return "milliseconds"
+	case annotationEnum:
+		return strings.Join(s.Values, " \\| ")
+	case annotationList:
+		return "comma-separated list"
+	case annotationKeyValueList:
+		return "comma-separated name=value list"
+	case annotationHex:
+		return "hex"
+	case annotationHexList:
+		return "comma-separated hex list"
+	case annotationStatusRange:
+		return "status range"
+	case annotationVersionWeights:
+		return "version=percent list"
+	case annotationSamplingPercent:
+		return "percent (0-100, decimal)"
+	case annotationTracingTags:
+		return "comma-separated header list"
+	}
+	return "string"
+}
+
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// AnnotationError reports an unknown annotation or an invalid value
+type AnnotationError struct {
+	Node    string `json:"node,omitempty"`
+	Service string `json:"service"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Message string `json:"message"`
+}
+
+func (e AnnotationError) Error() string {
+	return fmt.Sprintf("node %s, service %s: annotation %s=%q: %s", e.Node, e.Service, e.Key, e.Value, e.Message)
+}
+
+// ValidateAnnotations returns an error per unknown annotation and invalid value
+// the errors are ordered by key
+func ValidateAnnotations(ann map[string]string) []AnnotationError {
+	var keys []string
+	for key := range ann {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []AnnotationError
+	for _, key := range keys {
+		spec := lookupAnnotation(key)
+		if spec == nil {
+			msg := "unknown annotation"
+			if similar := similarAnnotation(key); similar != "" {
+				msg = fmt.Sprintf("unknown annotation, did you mean %s?", similar)
+			}
+			errs = append(errs, AnnotationError{Key: key, Value: ann[key], Message: msg})
+			continue
+		}
+		if err := spec.Validate(ann[key]); err != nil {
+			errs = append(errs, AnnotationError{Key: key, Value: ann[key], Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// validateClusters validates the annotations of all clusters and endpoints
+// the errors are reported once per node and service,
+// the errors of global services have no node
+func validateClusters(providerClusters map[string][]Cluster, globalServices []Cluster) []AnnotationError {
+	var nodes []string
+	for node := range providerClusters {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var errs []AnnotationError
+	for _, cluster := range globalServices {
+		errs = append(errs, validateCluster("", cluster)...)
+	}
+	for _, node := range nodes {
+		for _, cluster := range providerClusters[node] {
+			errs = append(errs, validateCluster(node, cluster)...)
+		}
+	}
+	return errs
+}
+
+func validateCluster(node string, cluster Cluster) []AnnotationError {
+	var errs []AnnotationError
+	seen := make(map[AnnotationError]struct{})
+	add := func(ann map[string]string) {
+		for _, err := range ValidateAnnotations(ann) {
+			err.Node = node
+			err.Service = cluster.Name
+			if _, ok := seen[err]; ok {
+				continue
+			}
+			seen[err] = struct{}{}
+			errs = append(errs, err)
+		}
+	}
+	add(cluster.Annotations)
+	for _, ep := range cluster.Endpoints {
+		add(ep.Annotations)
+	}
+	return errs
+}
+
+// annotationStatus holds the annotation errors of the last update
+type annotationStatus struct {
+	mu     sync.Mutex
+	errors []AnnotationError
+}
+
+// set stores the errors and logs them if they changed since the last update
+func (s *annotationStatus) set(errs []AnnotationError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(s.errors, errs) {
+		return
+	}
+	for _, err := range errs {
+		log.Warnf("invalid annotation: %s", err)
+	}
+	s.errors = errs
+}
+
+func (s *annotationStatus) get() []AnnotationError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]AnnotationError, len(s.errors))
+	copy(errs, s.errors)
+	return errs
+}
+
+// similarAnnotation returns the known annotation which is at most
+// two edits away from the key, e.g. because of a typo
+func similarAnnotation(key string) string {
+	best, bestDistance := "", 3
+	for _, spec := range annotationRegistry {
+		if d := editDistance(key, spec.Key); d < bestDistance {
+			best, bestDistance = spec.Key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// AnnotationReference returns the reference table of all annotations as markdown
+func AnnotationReference() string {
+	var buf bytes.Buffer
+	buf.WriteString("| Annotation | Level | Type | Default | Description |\n")
+	buf.WriteString("|---|---|---|---|---|\n")
+	for _, spec := range annotationRegistry {
+		def := spec.Default
+		if def == "" {
+			def = "-"
+		}
+		fmt.Fprintf(&buf, "| `%s` | %s | %s | %s | %s |\n", spec.Key, spec.Level, spec.typeName(), def, spec.Description)
+	}
+	return buf.String()
+}
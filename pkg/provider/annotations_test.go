@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestValidateAnnotations(t *testing.T) {
+	errs := ValidateAnnotations(map[string]string{
+		AnnotationProtocol:             "grpc",
+		AnnotationHealthExpectedStatus: "200-300",
+		AnnotationTrafficSplit:         "v1=90,v2=10",
+		AnnotationHealthDisabled:       "",
+		AnnotationOutlierDisabled:      "false",
+		AnnotationGRPCNumRetries:       "0",
+		AnnotationTimeoutRequest:       "0",
+		AnnotaionEndpointWeight:        "128",
+	})
+	assert.Check(t, is.Len(errs, 0))
+
+	errs = ValidateAnnotations(map[string]string{
+		AnnotationProtocol:             "udp",
+		AnnotaionEndpointWeight:        "-1",
+		AnnotaionFaultAbortCode:        "700",
+		AnnotationHealthExpectedStatus: "200",
+		AnnotationOutlierDisabled:      "no",
+		AnnotationTimeoutConnect:       "0",
+		"timeout.requets":              "100",
+		"foo":                          "bar",
+	})
+	assert.Assert(t, is.Len(errs, 8))
+	// ordered by key
+	assert.Check(t, is.Equal(errs[0].Key, AnnotaionEndpointWeight))
+	assert.Check(t, is.Equal(errs[0].Message, "must be a positive number"))
+	assert.Check(t, is.Equal(errs[1].Key, AnnotaionFaultAbortCode))
+	assert.Check(t, is.Equal(errs[1].Message, "must be within 200-599"))
+	assert.Check(t, is.Equal(errs[2].Key, "foo"))
+	assert.Check(t, is.Equal(errs[2].Message, "unknown annotation"))
+	assert.Check(t, is.Equal(errs[3].Key, AnnotationHealthExpectedStatus))
+	assert.Check(t, is.Equal(errs[4].Key, AnnotationOutlierDisabled))
+	assert.Check(t, is.Equal(errs[4].Message, "must be empty, true or false"))
+	assert.Check(t, is.Equal(errs[5].Key, AnnotationProtocol))
+	assert.Check(t, is.Contains(errs[5].Message, "must be one of"))
+	assert.Check(t, is.Equal(errs[6].Key, AnnotationTimeoutConnect))
+	assert.Check(t, is.Equal(errs[6].Message, "must be within 1 and more"))
+	assert.Check(t, is.Equal(errs[7].Message, "unknown annotation, did you mean timeout.request?"))
+}
+
+func TestValidateClusters(t *testing.T) {
+	global := []Cluster{
+		{
+			Name:        "stripe",
+			Annotations: map[string]string{AnnotationTimeoutRequest: "soon"},
+			Endpoints:   []Endpoint{{Address: "10.1.0.1", Annotations: map[string]string{AnnotationTimeoutRequest: "soon"}}},
+		},
+	}
+	errs := validateClusters(map[string][]Cluster{
+		"alpha": {
+			{
+				Name: "alpha.svc",
+				Endpoints: []Endpoint{
+					{Address: "10.0.0.1", Annotations: map[string]string{AnnotationLBPolicy: "fastest"}},
+					{Address: "10.0.0.2", Annotations: map[string]string{AnnotationLBPolicy: "fastest"}},
+				},
+			},
+		},
+		"beta": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "10.0.0.3", Annotations: map[string]string{AnnotationLBPolicy: "maglev"}}},
+			},
+		},
+	}, global)
+	// reported once per node and service, global services first
+	assert.Assert(t, is.Len(errs, 2))
+	assert.Check(t, is.Equal(errs[0].Node, ""))
+	assert.Check(t, is.Equal(errs[0].Service, "stripe"))
+	assert.Check(t, is.Equal(errs[0].Key, AnnotationTimeoutRequest))
+	assert.Check(t, is.Equal(errs[1].Node, "alpha"))
+	assert.Check(t, is.Equal(errs[1].Service, "alpha.svc"))
+	assert.Check(t, is.Equal(errs[1].Key, AnnotationLBPolicy))
+	assert.Check(t, is.Equal(errs[1].Value, "fastest"))
+}
+
+func TestAnnotationReference(t *testing.T) {
+	ref := AnnotationReference()
+	for _, spec := range annotationRegistry {
+		assert.Check(t, is.Contains(ref, "| `"+spec.Key+"` |"))
+	}
+	assert.Check(t, is.Equal(strings.Count(ref, "\n"), len(annotationRegistry)+2))
+}
+
+func TestAnnotationDefaults(t *testing.T) {
+	// the documented defaults equal the parsed defaults
+	// descriptive defaults like "mesh config" are skipped
+	for _, spec := range annotationRegistry {
+		if spec.Default == "" || spec.Validate(spec.Default) != nil {
+			continue
+		}
+		ann := map[string]string{spec.Key: spec.Default}
+		if spec.Level == levelEndpoint {
+			assert.Check(t, is.DeepEqual(Endpoint{Annotations: ann}.Config(), Endpoint{}.Config()), spec.Key)
+			continue
+		}
+		assert.Check(t, is.DeepEqual(parseClusterAnnotations(ann), parseClusterAnnotations(nil)), spec.Key)
+	}
+
+	// values out of the range of the spec fall back to the default
+	assert.Check(t, is.Equal(Endpoint{Annotations: map[string]string{AnnotaionEndpointWeight: "129"}}.Config().Weight, uint32(defaultEndpointWeight)))
+	cfg := parseClusterAnnotations(map[string]string{AnnotaionFaultAbortCode: "700"})
+	assert.Check(t, is.Equal(cfg.FaultConfig.AbortCode, uint32(defaultFaultAbortCode)))
+	cfg = parseClusterAnnotations(map[string]string{AnnotationTimeoutConnect: "0"})
+	assert.Check(t, is.Equal(cfg.Timeout.Connect, time.Millisecond*defaultConnectTimeout))
+
+	// zero is accepted if the spec allows it
+	cfg = parseClusterAnnotations(map[string]string{AnnotationGRPCNumRetries: "0", AnnotationTimeoutRequest: "0"})
+	assert.Check(t, is.Equal(cfg.GRPC.NumRetries, uint32(0)))
+	assert.Check(t, is.Equal(cfg.Timeout.Request, time.Duration(0)))
+}
+
+func TestGetBool(t *testing.T) {
+	ann := map[string]string{
+		AnnotationHealthDisabled:  "",
+		AnnotationOutlierDisabled: "false",
+		AnnotationHealthRespond:   "true",
+		AnnotationAuthzEnabled:    "maybe",
+	}
+	assert.Check(t, is.Equal(getBool(ann, AnnotationHealthDisabled, false), true))
+	assert.Check(t, is.Equal(getBool(ann, AnnotationOutlierDisabled, true), false))
+	assert.Check(t, is.Equal(getBool(ann, AnnotationHealthRespond, false), true))
+	// invalid values fall back
+	assert.Check(t, is.Equal(getBool(ann, AnnotationAuthzEnabled, false), false))
+	assert.Check(t, is.Equal(getBool(ann, AnnotationLBHashSourceIP, false), false))
+}
+
+func TestParseInt64Range(t *testing.T) {
+	lower, upper := parseInt64RangeWithFallback("200-300", 200, 400)
+	assert.Check(t, is.Equal(lower, int64(200)))
+	assert.Check(t, is.Equal(upper, int64(300)))
+	lower, upper = parseInt64RangeWithFallback("200", 200, 400)
+	assert.Check(t, is.Equal(lower, int64(200)))
+	assert.Check(t, is.Equal(upper, int64(400)))
+}
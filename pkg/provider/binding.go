@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/moolen/bent/envoy/api/v2/route"
+)
+
+const defaultBindingAddress = "127.0.0.1"
+
+// ServiceBinding binds a dependency of a node to a dedicated port
+// the apps connect to it directly instead of using HTTP_PROXY or the Host header
+type ServiceBinding struct {
+	Service string `yaml:"service"`
+	// Address defaults to 127.0.0.1
+	Address string `yaml:"address"`
+	Port    uint32 `yaml:"port"`
+}
+
+func (b ServiceBinding) address() string {
+	if b.Address == "" {
+		return defaultBindingAddress
+	}
+	return b.Address
+}
+
+// Validate returns an error if the binding is invalid
+func (b ServiceBinding) Validate() error {
+	if b.Service == "" {
+		return fmt.Errorf("missing service")
+	}
+	if b.Port == 0 || b.Port > 65535 {
+		return fmt.Errorf("invalid port of %s: %d", b.Service, b.Port)
+	}
+	if net.ParseIP(b.address()) == nil {
+		return fmt.Errorf("invalid address of %s: %s", b.Service, b.Address)
+	}
+	return nil
+}
+
+// a service may be bound to multiple ports
+// the names contain the port because they must be unique
+func bindingListenerName(b ServiceBinding) string {
+	return fmt.Sprintf("bind-%s-%d", b.Service, b.Port)
+}
+
+func bindingRouteName(b ServiceBinding) string {
+	return fmt.Sprintf("bind_%s_%d", b.Service, b.Port)
+}
+
+// ParseServiceBindings parses the bindings from a flat map
+// e.g. beta.svc: 5001, gamma.svc: 127.0.0.2:5002
+func ParseServiceBindings(in map[string]string) ([]ServiceBinding, error) {
+	var bindings []ServiceBinding
+	for service, val := range in {
+		binding := ServiceBinding{Service: service}
+		port := val
+		if strings.Contains(val, ":") {
+			var err error
+			binding.Address, port, err = net.SplitHostPort(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid binding of %s: %s", service, err)
+			}
+		}
+		num, err := parseUInt32(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of %s: %s", service, err)
+		}
+		binding.Port = num
+		if err := binding.Validate(); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].Service < bindings[j].Service
+	})
+	return bindings, nil
+}
+
+// createBindingVHost returns a vhost which matches all hosts
+// the host header is rewritten because the callee sidecar routes by it
+func createBindingVHost(cfg VHostConfig) route.VirtualHost {
+	if cfg.HostRewrite == "" {
+		cfg.HostRewrite = cfg.Hostname
+	}
+	vhost := createEnvoyVHost(cfg)
+	vhost.Domains = []string{"*"}
+	return vhost
+}
@@ -0,0 +1,23 @@
+package provider
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseServiceBindings(t *testing.T) {
+	bindings, err := ParseServiceBindings(map[string]string{
+		"gamma.svc": "127.0.0.2:5002",
+		"beta.svc":  "5001",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, bindings, []ServiceBinding{
+		{Service: "beta.svc", Port: 5001},
+		{Service: "gamma.svc", Address: "127.0.0.2", Port: 5002},
+	})
+	_, err = ParseServiceBindings(map[string]string{"beta.svc": "http"})
+	assert.ErrorContains(t, err, "invalid port of beta.svc")
+	_, err = ParseServiceBindings(map[string]string{"beta.svc": "localhost:5001"})
+	assert.ErrorContains(t, err, "invalid address of beta.svc")
+}
@@ -1,7 +1,12 @@
 package provider
 
 import (
+	"encoding/hex"
+	"strconv"
+	"strings"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -9,33 +14,166 @@ const (
 	defaultHealthTimeout       = 3000  // in ms
 	defaultHealthInterval      = 10000 // in ms
 	defaultHealthCacheDuration = 30000 // in ms
+	defaultHealthThreshold     = 3
+	// defaultHealthMinHealthyPercent requires all local endpoints to be healthy
+	defaultHealthMinHealthyPercent = 100
+	// the expected status range of HTTP health checks, the upper bound is exclusive
+	defaultHealthExpectedStatusLower = 200
+	defaultHealthExpectedStatusUpper = 400
+
+	healthCheckHTTP = "http"
+	healthCheckTCP  = "tcp"
+	healthCheckGRPC = "grpc"
+	// the path of the requests of the gRPC health checking protocol
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+	protocolHTTP  = "http"
+	protocolHTTP1 = "http1"
+	protocolHTTP2 = "http2"
+	protocolGRPC  = "grpc"
+	protocolTCP   = "tcp"
+
+	defaultGRPCRetryOn = "cancelled,deadline-exceeded,resource-exhausted,unavailable"
+	defaultGRPCRetries = 2
+
+	defaultRequestTimeout = 15000 // in ms
+	defaultConnectTimeout = 1000  // in ms
+
+	defaultOutlierInterval         = 10000 // in ms
+	defaultOutlierBaseEjectionTime = 30000 // in ms
+	defaultHashCookieTTL           = 0     // in ms, session cookie
+
+	defaultCBMaxConnections     = 1000
+	defaultCBMaxPendingRequests = 1000
+	defaultCBMaxRequests        = 1000
+	defaultCBMaxRetries         = 3
+
+	defaultOutlierConsecutive5xx           = 5
+	defaultOutlierMaxEjectionPercent       = 50
+	defaultOutlierSuccessRateEnforcing     = 100
+	defaultOutlierSuccessRateMinHosts      = 5
+	defaultOutlierSuccessRateRequestVolume = 100
+	defaultOutlierSuccessRateStdevFactor   = 1900
+
+	defaultMirrorPercent = 100
+
+	defaultFaultDelayDuration = 30 // in ms
+	defaultFaultAbortCode     = 503
+
+	lbPolicyRoundRobin   = "round-robin"
+	lbPolicyLeastRequest = "least-request"
+	lbPolicyRandom       = "random"
+	lbPolicyRingHash     = "ring-hash"
+	lbPolicyMaglev       = "maglev"
 )
 
 // Cluster represents a group of endpoints
+// the annotations of the cluster apply to all endpoints,
+// the annotations of an endpoint take precedence
 type Cluster struct {
-	Name      string     `yaml:"name"`
-	Endpoints []Endpoint `yaml:"endpoints"`
+	Name        string            `yaml:"name"`
+	Annotations map[string]string `yaml:"annotations"`
+	Endpoints   []Endpoint        `yaml:"endpoints"`
+	Routes      []RouteRule       `yaml:"routes"`
 }
 
 // ClusterConfig defines the cluster behavior
 // this config is filled by annotations
 type ClusterConfig struct {
+	// Protocol specifies the protocol of the service, one of http1, http2, grpc or tcp
+	Protocol       string
+	TCP            ClusterTCPConfig
+	GRPC           ClusterGRPCConfig
 	HealthCheck    ClusterHealthCheckConfig
 	CircuitBreaker ClusterCircuitBreakerConfig
+	Timeout        ClusterTimeoutConfig
+	Outlier        ClusterOutlierConfig
+	LoadBalancer   ClusterLoadBalancerConfig
+	// TrafficSplit specifies the weights of the service versions
+	TrafficSplit []VersionWeight
+	Mirror       ClusterMirrorConfig
+	Authz        ClusterAuthzConfig
+	Tracing      ClusterTracingConfig
 	// for now, the cluster specifies the fault configuration
 	// of the INGRESS traffic
 	FaultConfig FaultConfig
 }
 
+// ClusterTCPConfig defines the listener ports of a tcp service
+type ClusterTCPConfig struct {
+	// EgressPort is the port of the consumer sidecars
+	// which the app connects to
+	EgressPort uint32
+	// IngressPort is the port of the sidecars which expose the service
+	IngressPort uint32
+}
+
+// ClusterGRPCConfig defines the retry behavior of a gRPC service
+type ClusterGRPCConfig struct {
+	// RetryOn specifies the gRPC status codes which are retried
+	// retries are disabled if empty
+	RetryOn    string
+	NumRetries uint32
+}
+
+// HTTP2 returns true if the upstream connections use HTTP/2
+func (c ClusterConfig) HTTP2() bool {
+	return c.Protocol == protocolHTTP2 || c.Protocol == protocolGRPC
+}
+
 // ClusterHealthCheckConfig defines the health-checking behavior of a cluster
 type ClusterHealthCheckConfig struct {
-	Path                string
-	Timeout             time.Duration
-	Interval            time.Duration
-	CacheDuration       time.Duration
+	// Disabled turns off active health checking
+	Disabled bool
+	// Type is one of http, tcp or grpc
+	Type               string
+	Path               string
+	Timeout            time.Duration
+	Interval           time.Duration
+	IntervalJitter     time.Duration
+	NoTrafficInterval  time.Duration
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+	CacheDuration      time.Duration
+	// Respond lets envoy answer the health checks of peers
+	// based on the healthy hosts of the local cluster
+	Respond             bool
+	MinHealthyPercent   uint32
 	Port                uint32
 	ExpectedStatusLower int64
 	ExpectedStatusUpper int64
+	// Host and Headers are sent with HTTP health checks
+	Host    string
+	Headers map[string]string
+	// TCPSend and TCPReceive are hex encoded payloads
+	// an empty TCPSend only checks whether a connection can be established
+	TCPSend    string
+	TCPReceive []string
+	// GRPCService is the service name of the gRPC health check request
+	GRPCService string
+}
+
+// peer returns the health check of the sidecars which expose the service
+// the checks pass the ingress listener of the sidecar which routes by host,
+// the host, the port and the tcp payloads only apply to the local endpoints
+func (c ClusterHealthCheckConfig) peer(service string) ClusterHealthCheckConfig {
+	c.Host = service
+	c.Port = 0
+	c.TCPSend = ""
+	c.TCPReceive = nil
+	return c
+}
+
+// requestPath returns the HTTP path of the health check requests
+// it is empty for tcp health checks
+func (c ClusterHealthCheckConfig) requestPath() string {
+	switch c.Type {
+	case healthCheckTCP:
+		return ""
+	case healthCheckGRPC:
+		return grpcHealthCheckPath
+	}
+	return c.Path
 }
 
 // ClusterCircuitBreakerConfig defines the circuit-breaker behavior of a cluster
@@ -46,7 +184,73 @@ type ClusterCircuitBreakerConfig struct {
 	MaxRetries         uint32
 }
 
-// Config parses the annotations of the cluster and return a cluster config
+// ClusterTimeoutConfig defines the timeouts of a cluster and its routes
+// a zero value means that the envoy default is used
+type ClusterTimeoutConfig struct {
+	Request           time.Duration
+	Idle              time.Duration
+	Connect           time.Duration
+	MaxStreamDuration time.Duration
+}
+
+// ClusterOutlierConfig defines the outlier detection behavior of a cluster
+type ClusterOutlierConfig struct {
+	Enabled                  bool
+	Consecutive5xx           uint32
+	ConsecutiveGatewayErrors uint32
+	Interval                 time.Duration
+	BaseEjectionTime         time.Duration
+	MaxEjectionPercent       uint32
+	SuccessRateEnforcing     uint32
+	SuccessRateMinimumHosts  uint32
+	SuccessRateRequestVolume uint32
+	SuccessRateStdevFactor   uint32
+}
+
+// ClusterLoadBalancerConfig defines the load balancing behavior of a cluster
+// the hash settings are only used by the hash-based policies
+type ClusterLoadBalancerConfig struct {
+	Policy        string
+	HashHeader    string
+	HashCookie    string
+	HashCookieTTL time.Duration
+	HashSourceIP  bool
+}
+
+// HashBased returns true if the policy uses consistent hashing
+func (c ClusterLoadBalancerConfig) HashBased() bool {
+	return c.Policy == lbPolicyRingHash || c.Policy == lbPolicyMaglev
+}
+
+// ClusterMirrorConfig defines the request mirror policy of a service
+type ClusterMirrorConfig struct {
+	Service string
+	Percent uint32
+}
+
+// ClusterAuthzConfig defines the authorization behavior of a service
+type ClusterAuthzConfig struct {
+	Enabled       bool
+	DisabledPaths []string
+}
+
+// ClusterTracingConfig defines the tracing behavior of the nodes which expose the service
+// a nil sampling percentage means that the mesh default is used
+type ClusterTracingConfig struct {
+	ClientSampling  *float64
+	RandomSampling  *float64
+	OverallSampling *float64
+	Tags            []string
+}
+
+// VersionWeight specifies the share of traffic a service version receives
+type VersionWeight struct {
+	Version string
+	Weight  uint32
+}
+
+// Config parses the annotations of the cluster and its endpoints
+// and returns a cluster config
 func (c Cluster) Config() ClusterConfig {
 	merged := mergeAnnotations(c)
 	return parseClusterAnnotations(merged)
@@ -56,50 +260,145 @@ func (c Cluster) Config() ClusterConfig {
 // it will pre-fill sane default values
 func parseClusterAnnotations(ann map[string]string) ClusterConfig {
 	lower, upper := parseInt64RangeWithFallback(
-		ann[AnnotationHealthExpectedStatus], 200, 400)
+		ann[AnnotationHealthExpectedStatus], defaultHealthExpectedStatusLower, defaultHealthExpectedStatusUpper)
+
+	protocol := getProtocol(ann, AnnotationProtocol, protocolHTTP1)
+	// tcp services can't be checked via HTTP
+	// gRPC services use the gRPC health checking protocol
+	// and don't have a default request timeout because of streaming
+	healthCheckType := healthCheckHTTP
+	requestTimeout := defaultRequestTimeout
+	switch protocol {
+	case protocolTCP:
+		healthCheckType = healthCheckTCP
+	case protocolGRPC:
+		healthCheckType = healthCheckGRPC
+		requestTimeout = 0
+	}
+	egressPort := getUInt32(ann, AnnotationTCPEgressPort, 0)
+	var ingressPort uint32
+	if egressPort > 0 {
+		ingressPort = egressPort + defaultIngressTrafficPort - defaultEgressTrafficPort
+	}
 
 	cc := ClusterConfig{
+		Protocol: protocol,
+		TCP: ClusterTCPConfig{
+			EgressPort:  egressPort,
+			IngressPort: getUInt32(ann, AnnotationTCPIngressPort, ingressPort),
+		},
+		GRPC: ClusterGRPCConfig{
+			RetryOn:    getString(ann, AnnotationGRPCRetryOn, defaultGRPCRetryOn),
+			NumRetries: getUInt32(ann, AnnotationGRPCNumRetries, defaultGRPCRetries),
+		},
 		FaultConfig: FaultConfig{
 			Enabled:       getBool(ann, AnnotaionFaultInject, false),
-			DelayChance:   getUInt32(ann, AnnotaionFaultDelayPercent, 0),
-			DelayDuration: getDurationMilliseconds(ann, AnnotaionFaultDelayDuration, 30),
-			AbortChance:   getUInt32(ann, AnnotaionFaultAbortPercent, 0),
-			AbortCode:     getUInt32(ann, AnnotaionFaultAbortCode, 503),
+			DelayChance:   getPercent(ann, AnnotaionFaultDelayPercent, 0),
+			DelayDuration: getDurationMilliseconds(ann, AnnotaionFaultDelayDuration, defaultFaultDelayDuration),
+			AbortChance:   getPercent(ann, AnnotaionFaultAbortPercent, 0),
+			AbortCode:     getUInt32(ann, AnnotaionFaultAbortCode, defaultFaultAbortCode),
 		},
 		CircuitBreaker: ClusterCircuitBreakerConfig{
-			MaxConnections:     getUInt32(ann, AnnotaionCBMaxConn, 1000),
-			MaxPendingRequests: getUInt32(ann, AnnotaionCBMaxPending, 1000),
-			MaxRequests:        getUInt32(ann, AnnotaionCBMaxRequests, 1000),
-			MaxRetries:         getUInt32(ann, AnnotaionCBMaxRetries, 3),
+			MaxConnections:     getUInt32(ann, AnnotaionCBMaxConn, defaultCBMaxConnections),
+			MaxPendingRequests: getUInt32(ann, AnnotaionCBMaxPending, defaultCBMaxPendingRequests),
+			MaxRequests:        getUInt32(ann, AnnotaionCBMaxRequests, defaultCBMaxRequests),
+			MaxRetries:         getUInt32(ann, AnnotaionCBMaxRetries, defaultCBMaxRetries),
+		},
+		Timeout: ClusterTimeoutConfig{
+			Request:           getDurationMilliseconds(ann, AnnotationTimeoutRequest, requestTimeout),
+			Idle:              getDurationMilliseconds(ann, AnnotationTimeoutIdle, 0),
+			Connect:           getDurationMilliseconds(ann, AnnotationTimeoutConnect, defaultConnectTimeout),
+			MaxStreamDuration: getDurationMilliseconds(ann, AnnotationTimeoutMaxStreamDuration, 0),
+		},
+		Outlier: ClusterOutlierConfig{
+			Enabled:                  !getBool(ann, AnnotationOutlierDisabled, false),
+			Consecutive5xx:           getUInt32(ann, AnnotationOutlierConsecutive5xx, defaultOutlierConsecutive5xx),
+			ConsecutiveGatewayErrors: getUInt32(ann, AnnotationOutlierConsecutiveGatewayErrors, 0),
+			Interval:                 getDurationMilliseconds(ann, AnnotationOutlierInterval, defaultOutlierInterval),
+			BaseEjectionTime:         getDurationMilliseconds(ann, AnnotationOutlierBaseEjectionTime, defaultOutlierBaseEjectionTime),
+			MaxEjectionPercent:       getPercent(ann, AnnotationOutlierMaxEjectionPercent, defaultOutlierMaxEjectionPercent),
+			SuccessRateEnforcing:     getPercent(ann, AnnotationOutlierSuccessRateEnforcing, defaultOutlierSuccessRateEnforcing),
+			SuccessRateMinimumHosts:  getUInt32(ann, AnnotationOutlierSuccessRateMinHosts, defaultOutlierSuccessRateMinHosts),
+			SuccessRateRequestVolume: getUInt32(ann, AnnotationOutlierSuccessRateRequestVolume, defaultOutlierSuccessRateRequestVolume),
+			SuccessRateStdevFactor:   getUInt32(ann, AnnotationOutlierSuccessRateStdevFactor, defaultOutlierSuccessRateStdevFactor),
+		},
+		LoadBalancer: ClusterLoadBalancerConfig{
+			Policy:        getLBPolicy(ann, AnnotationLBPolicy, lbPolicyRoundRobin),
+			HashHeader:    getString(ann, AnnotationLBHashHeader, ""),
+			HashCookie:    getString(ann, AnnotationLBHashCookie, ""),
+			HashCookieTTL: getDurationMilliseconds(ann, AnnotationLBHashCookieTTL, defaultHashCookieTTL),
+			HashSourceIP:  getBool(ann, AnnotationLBHashSourceIP, false),
+		},
+		TrafficSplit: getTrafficSplit(ann, AnnotationTrafficSplit),
+		Mirror: ClusterMirrorConfig{
+			Service: getString(ann, AnnotationMirrorService, ""),
+			Percent: getPercent(ann, AnnotationMirrorPercent, defaultMirrorPercent),
+		},
+		Authz: ClusterAuthzConfig{
+			Enabled:       getBool(ann, AnnotationAuthzEnabled, false),
+			DisabledPaths: getStringList(ann, AnnotationAuthzDisabledPaths),
+		},
+		Tracing: ClusterTracingConfig{
+			ClientSampling:  getSamplingPercent(ann, AnnotationTracingClientSampling),
+			RandomSampling:  getSamplingPercent(ann, AnnotationTracingRandomSampling),
+			OverallSampling: getSamplingPercent(ann, AnnotationTracingOverallSampling),
+			Tags:            getTracingTags(ann, AnnotationTracingTags),
 		},
 		HealthCheck: ClusterHealthCheckConfig{
+			Disabled:            getBool(ann, AnnotationHealthDisabled, false),
+			Type:                getHealthCheckType(ann, AnnotationHealthType, healthCheckType),
 			Timeout:             getDurationMilliseconds(ann, AnnotationHealthTimeout, defaultHealthTimeout),
 			Interval:            getDurationMilliseconds(ann, AnnotationHealthInterval, defaultHealthInterval),
+			IntervalJitter:      getDurationMilliseconds(ann, AnnotationHealthIntervalJitter, 0),
+			NoTrafficInterval:   getDurationMilliseconds(ann, AnnotationHealthNoTrafficInterval, 0),
+			HealthyThreshold:    getUInt32(ann, AnnotationHealthHealthyThreshold, defaultHealthThreshold),
+			UnhealthyThreshold:  getUInt32(ann, AnnotationHealthUnhealthyThreshold, defaultHealthThreshold),
 			CacheDuration:       getDurationMilliseconds(ann, AnnotationHealthCacheDuration, defaultHealthCacheDuration),
+			Respond:             getBool(ann, AnnotationHealthRespond, false),
+			MinHealthyPercent:   getPercent(ann, AnnotationHealthMinHealthyPercent, defaultHealthMinHealthyPercent),
 			Path:                getString(ann, AnnotationHealthCheckPath, defaultHealthCheckPath),
 			Port:                getUInt32(ann, AnnotationHealthPort, 0),
 			ExpectedStatusLower: lower,
 			ExpectedStatusUpper: upper,
+			Host:                getString(ann, AnnotationHealthHost, ""),
+			Headers:             getStringMap(ann, AnnotationHealthHeaders),
+			TCPSend:             getHex(ann, AnnotationHealthTCPSend),
+			TCPReceive:          getHexList(ann, AnnotationHealthTCPReceive),
+			GRPCService:         getString(ann, AnnotationHealthGRPCService, ""),
 		},
 	}
 
 	return cc
 }
 
+// getUInt32 falls back if the value is out of the range of the annotation spec
+// getUInt32 accepts values within the bounds of the annotation spec
 func getUInt32(ann map[string]string, key string, fallback uint32) uint32 {
 	if _, ok := ann[key]; ok {
 		num := parseIntWithFallback(ann[key], -1)
-		if num > 0 {
+		if num >= 0 && annotationInRange(key, num) {
+			return uint32(num)
+		}
+	}
+	return fallback
+}
+
+// getPercent accepts values between 0 and 100
+func getPercent(ann map[string]string, key string, fallback uint32) uint32 {
+	if _, ok := ann[key]; ok {
+		num := parseIntWithFallback(ann[key], -1)
+		if num >= 0 && num <= 100 {
 			return uint32(num)
 		}
 	}
 	return fallback
 }
 
+// getDurationMilliseconds accepts values within the bounds of the annotation spec
 func getDurationMilliseconds(ann map[string]string, key string, fallback int) time.Duration {
 	if _, ok := ann[key]; ok {
 		num := parseIntWithFallback(ann[key], -1)
-		if num > 0 {
+		if num >= 0 && annotationInRange(key, num) {
 			return time.Millisecond * time.Duration(num)
 		}
 	}
@@ -113,10 +412,118 @@ func getString(ann map[string]string, key string, fallback string) string {
 	return fallback
 }
 
-// key set = true
+func getLBPolicy(ann map[string]string, key string, fallback string) string {
+	policy := getString(ann, key, fallback)
+	switch policy {
+	case lbPolicyRoundRobin, lbPolicyLeastRequest, lbPolicyRandom, lbPolicyRingHash, lbPolicyMaglev:
+		return policy
+	}
+	log.Warnf("invalid load balancing policy %s, using %s", policy, fallback)
+	return fallback
+}
+
+func getProtocol(ann map[string]string, key string, fallback string) string {
+	protocol := getString(ann, key, fallback)
+	switch protocol {
+	case protocolHTTP:
+		return protocolHTTP1
+	case protocolHTTP1, protocolHTTP2, protocolGRPC, protocolTCP:
+		return protocol
+	}
+	log.Warnf("invalid protocol %s, using %s", protocol, fallback)
+	return fallback
+}
+
+func getHealthCheckType(ann map[string]string, key string, fallback string) string {
+	typ := getString(ann, key, fallback)
+	switch typ {
+	case healthCheckHTTP, healthCheckTCP, healthCheckGRPC:
+		return typ
+	}
+	log.Warnf("invalid health check type %s, using %s", typ, fallback)
+	return fallback
+}
+
+// getStringMap parses a comma-separated list of key=value pairs
+// invalid pairs are ignored
+func getStringMap(ann map[string]string, key string) map[string]string {
+	var out map[string]string
+	for _, pair := range getStringList(ann, key) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			log.Warnf("invalid key=value pair in %s: %s", key, pair)
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return out
+}
+
+// getHex returns an empty string if the value is not hex encoded
+func getHex(ann map[string]string, key string) string {
+	val := getString(ann, key, "")
+	if _, err := hex.DecodeString(val); err != nil {
+		log.Warnf("invalid hex payload in %s: %s", key, err)
+		return ""
+	}
+	return val
+}
+
+// getHexList splits a comma-separated list of hex encoded payloads
+// invalid payloads are ignored
+func getHexList(ann map[string]string, key string) []string {
+	var list []string
+	for _, val := range getStringList(ann, key) {
+		if _, err := hex.DecodeString(val); err != nil {
+			log.Warnf("invalid hex payload in %s: %s", key, err)
+			continue
+		}
+		list = append(list, val)
+	}
+	return list
+}
+
+// getTrafficSplit returns nil if the split is invalid
+func getTrafficSplit(ann map[string]string, key string) []VersionWeight {
+	val, ok := ann[key]
+	if !ok {
+		return nil
+	}
+	split, err := parseVersionWeights(val)
+	if err != nil {
+		log.Warnf("invalid traffic split %s: %s", val, err)
+		return nil
+	}
+	return split
+}
+
+// getStringList splits a comma-separated list
+func getStringList(ann map[string]string, key string) []string {
+	var list []string
+	for _, val := range strings.Split(ann[key], ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			list = append(list, val)
+		}
+	}
+	return list
+}
+
+// getBool treats an empty value as true, invalid values fall back
 func getBool(ann map[string]string, key string, fallback bool) bool {
-	if _, ok := ann[key]; ok {
+	val, ok := ann[key]
+	if !ok {
+		return fallback
+	}
+	if val == "" {
 		return true
 	}
-	return fallback
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Warnf("invalid flag %s: %s", key, val)
+		return fallback
+	}
+	return b
 }
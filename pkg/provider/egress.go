@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/core"
+)
+
+const (
+	defaultEgressGatewayNode  = "egress"
+	egressGatewayCluster      = "egress_gateway"
+	egressGatewayHTTP2Cluster = "egress_gateway_http2"
+)
+
+// EgressGatewayConfig configures the egress gateway node
+// the sidecars send all requests to external services through the gateway
+type EgressGatewayConfig struct {
+	// Node specifies the envoy node id of the gateway, defaults to "egress"
+	Node string `yaml:"node"`
+	// Address specifies the DNS name of the gateway
+	// which is used by the sidecars
+	Address string `yaml:"address"`
+	// Port specifies the listener port of the gateway, defaults to 4100
+	Port uint32 `yaml:"port"`
+	// Allow specifies the external services which may be called
+	// "*" allows all external services
+	Allow []string `yaml:"allow"`
+}
+
+// Validate returns an error if the gateway can not be used
+func (g EgressGatewayConfig) Validate() error {
+	if g.Address == "" {
+		return fmt.Errorf("missing egress gateway address")
+	}
+	return nil
+}
+
+func (g EgressGatewayConfig) node() string {
+	if g.Node == "" {
+		return defaultEgressGatewayNode
+	}
+	return g.Node
+}
+
+func (g EgressGatewayConfig) port() uint32 {
+	if g.Port == 0 {
+		return defaultIngressTrafficPort
+	}
+	return g.Port
+}
+
+// allowed returns true if the external service is on the allowlist
+func (g EgressGatewayConfig) allowed(name string) bool {
+	for _, allow := range g.Allow {
+		if allow == name || allow == allDependencies {
+			return true
+		}
+	}
+	return false
+}
+
+// egressGatewayClusterName returns the gateway cluster of the external service
+// HTTP/2 requests are sent on a dedicated cluster because the protocol
+// of the upstream connections is fixed per cluster
+func egressGatewayClusterName(s ExternalService) string {
+	if s.Cluster().Config().HTTP2() {
+		return egressGatewayHTTP2Cluster
+	}
+	return egressGatewayCluster
+}
+
+// createEgressGatewayCluster returns the cluster which the sidecars
+// use to connect to the egress gateway
+func createEgressGatewayCluster(g EgressGatewayConfig, s ExternalService) *v2.Cluster {
+	cluster := createExternalCluster(ExternalService{
+		Name: egressGatewayClusterName(s),
+		Host: g.Address,
+		Port: g.port(),
+	})
+	if cluster.Name == egressGatewayHTTP2Cluster {
+		cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	}
+	return cluster
+}
+
+// egressGatewayClusters returns the external services of the gateway
+// they are not health checked
+func egressGatewayClusters(external map[string]ExternalService) []Cluster {
+	var clusters []Cluster
+	for _, s := range external {
+		cluster := s.Cluster()
+		cluster.Annotations = map[string]string{
+			AnnotationHealthDisabled: "",
+		}
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+	return clusters
+}
+
+// createEgressGatewayVHost returns the sidecar vhost of the external service
+// the host header is retained so the gateway can route the request
+func createEgressGatewayVHost(s ExternalService) VHostConfig {
+	return VHostConfig{
+		Hostname: s.name(),
+		Cluster:  egressGatewayClusterName(s),
+		Config:   s.Cluster().Config(),
+		Port:     s.Port,
+	}
+}
@@ -1,6 +1,6 @@
 package provider
 
-import log "github.com/sirupsen/logrus"
+const defaultEndpointWeight = 64
 
 // Endpoint represents a address/port combination
 type Endpoint struct {
@@ -11,7 +11,8 @@ type Endpoint struct {
 
 // EndpointConfig defines the behavior of a endpoint
 type EndpointConfig struct {
-	Weight uint32
+	Weight  uint32
+	Version string
 }
 
 // Config parses the endpoints annotations and returns the endpoint config
@@ -22,13 +23,9 @@ func (e Endpoint) Config() EndpointConfig {
 // this func looks up values in the annotations of the endpoint
 // it will pre-fill sane default values (weight must be: 0 < weight <= 128)
 func (e Endpoint) parseEndpointAnnotations() EndpointConfig {
-	weight := getUInt32(e.Annotations, AnnotaionEndpointWeight, 64)
-	if weight == 0 || weight > 128 {
-		weight = 64
-		log.Warnf("weight of endpoint %s has invalid weight", e.Address)
-	}
 	cc := EndpointConfig{
-		Weight: weight,
+		Weight:  getUInt32(e.Annotations, AnnotaionEndpointWeight, defaultEndpointWeight),
+		Version: getString(e.Annotations, AnnotationEndpointVersion, ""),
 	}
 
 	return cc
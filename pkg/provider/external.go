@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/auth"
+	"github.com/moolen/bent/envoy/api/v2/core"
+	"github.com/moolen/bent/envoy/api/v2/endpoint"
+)
+
+const (
+	resolutionStrict  = "strict"
+	resolutionLogical = "logical"
+
+	// defaultCACertificate is the system CA bundle of the envoy container
+	defaultCACertificate = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// ExternalService defines a service outside of the mesh which is resolved via DNS
+type ExternalService struct {
+	// Name specifies the hostname which the apps use to call the service
+	// defaults to Host
+	Name string `yaml:"name"`
+	// Host specifies the DNS name of the service
+	Host string `yaml:"host"`
+	Port uint32 `yaml:"port"`
+	// TLS originates TLS to the service, the apps use plaintext HTTP
+	TLS bool `yaml:"tls"`
+	// SNI specifies the server name of the TLS handshake, defaults to Host
+	// the server certificate must be valid for this name
+	SNI string `yaml:"sni"`
+	// CACertificate specifies the file of the trusted CAs in the envoy container
+	// defaults to the system CA bundle
+	CACertificate string `yaml:"caCertificate"`
+	// Resolution is either strict (all resolved addresses are used)
+	// or logical (only the first resolved address is used), defaults to strict
+	Resolution string `yaml:"resolution"`
+	// Annotations configure timeouts, circuit breakers, outlier detection etc.
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+func (s ExternalService) name() string {
+	if s.Name == "" {
+		return s.Host
+	}
+	return s.Name
+}
+
+// Validate returns an error if the external service can not be used
+func (s ExternalService) Validate() error {
+	if s.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if s.Port == 0 {
+		return fmt.Errorf("missing port of %s", s.Host)
+	}
+	if s.Resolution != "" && s.Resolution != resolutionStrict && s.Resolution != resolutionLogical {
+		return fmt.Errorf("invalid resolution of %s: %s", s.Host, s.Resolution)
+	}
+	return nil
+}
+
+// Cluster returns the external service as a cluster with a single endpoint
+func (s ExternalService) Cluster() Cluster {
+	return Cluster{
+		Name: s.name(),
+		Endpoints: []Endpoint{
+			{
+				Address:     s.Host,
+				Port:        s.Port,
+				Annotations: s.Annotations,
+			},
+		},
+	}
+}
+
+// createExternalCluster returns a DNS cluster for the external service
+// there are no active health checks, outlier detection has to be used instead
+func createExternalCluster(s ExternalService) *v2.Cluster {
+	c := s.Cluster()
+	cluster := createEnvoyCluster(c)
+	cluster.Type = v2.Cluster_STRICT_DNS
+	if s.Resolution == resolutionLogical {
+		cluster.Type = v2.Cluster_LOGICAL_DNS
+	}
+	cluster.EdsClusterConfig = nil
+	cluster.HealthChecks = nil
+	cluster.LoadAssignment = &v2.ClusterLoadAssignment{
+		ClusterName: c.Name,
+		Endpoints: []endpoint.LocalityLbEndpoints{
+			{
+				LbEndpoints: createEnvoyEndpoint(c.Endpoints),
+			},
+		},
+	}
+	if s.TLS {
+		cluster.TlsContext = createExternalTLSContext(s)
+	}
+	return cluster
+}
+
+// createExternalTLSContext verifies the certificate of the service
+// against the trusted CAs and the server name
+func createExternalTLSContext(s ExternalService) *auth.UpstreamTlsContext {
+	sni := s.SNI
+	if sni == "" {
+		sni = s.Host
+	}
+	ca := s.CACertificate
+	if ca == "" {
+		ca = defaultCACertificate
+	}
+	return &auth.UpstreamTlsContext{
+		Sni: sni,
+		CommonTlsContext: &auth.CommonTlsContext{
+			ValidationContextType: &auth.CommonTlsContext_ValidationContext{
+				ValidationContext: &auth.CertificateValidationContext{
+					TrustedCa: &core.DataSource{
+						Specifier: &core.DataSource_Filename{
+							Filename: ca,
+						},
+					},
+					VerifySubjectAltName: []string{sni},
+				},
+			},
+		},
+	}
+}
+
+// createExternalVHost returns the egress vhost of the external service
+// there is no callee sidecar, the host header is rewritten by the caller
+func createExternalVHost(s ExternalService) VHostConfig {
+	return VHostConfig{
+		Hostname:    s.name(),
+		Cluster:     s.name(),
+		Config:      s.Cluster().Config(),
+		Port:        s.Port,
+		HostRewrite: s.Host,
+	}
+}
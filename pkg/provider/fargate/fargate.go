@@ -2,8 +2,10 @@ package fargate
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,6 +19,14 @@ import (
 type Provider struct {
 	Session *session.Session
 	Client  *ecs.ECS
+
+	// nodes holds the node config found in the last GetClusters call
+	nodes *nodeConfigStore
+}
+
+type nodeConfigStore struct {
+	sync.Mutex
+	config map[string]provider.NodeConfig
 }
 
 // NewProvider returns a new provider
@@ -29,6 +39,7 @@ func NewProvider() (*Provider, error) {
 	return &Provider{
 		Session: session,
 		Client:  client,
+		nodes:   &nodeConfigStore{},
 	}, nil
 }
 
@@ -38,6 +49,7 @@ func NewProvider() (*Provider, error) {
 //   - a container within a task can expose _multiple_ services
 func (p Provider) GetClusters() (map[string][]provider.Cluster, error) {
 	localClusters := make(map[string][]provider.Cluster)
+	nodeConfig := make(map[string]provider.NodeConfig)
 	clusters, err := p.listClusters()
 	if err != nil {
 		return nil, err
@@ -58,8 +70,8 @@ func (p Provider) GetClusters() (map[string][]provider.Cluster, error) {
 		for _, tasks := range serviceTasks {
 			for _, task := range tasks {
 				taskdef := serviceTaskDefs[*task.TaskDefinitionArn]
-				// find related endpoints
-				taskEndpoints, err := p.findEndpoints(task, taskdef)
+				// find related clusters
+				taskClusters, err := p.findClusters(task, taskdef)
 				if err != nil {
 					log.Warnf("error finding endpoints for task %s: %s", *task.TaskArn, err)
 					continue
@@ -72,19 +84,28 @@ func (p Provider) GetClusters() (map[string][]provider.Cluster, error) {
 
 				// defaults: every task may launch a sidecar
 				localClusters[nodeID] = []provider.Cluster{}
+				nodeConfig[nodeID] = findNodeConfig(taskdef)
 
-				for name, endpoints := range taskEndpoints {
-					localClusters[nodeID] = append(localClusters[nodeID], provider.Cluster{
-						Name:      name,
-						Endpoints: endpoints,
-					})
+				for _, cluster := range taskClusters {
+					localClusters[nodeID] = append(localClusters[nodeID], cluster)
 				}
 			}
 		}
 	}
+	p.nodes.Lock()
+	p.nodes.config = nodeConfig
+	p.nodes.Unlock()
 	return localClusters, nil
 }
 
+// GetNodeConfig returns the node config of the tasks
+// found in the last GetClusters call
+func (p Provider) GetNodeConfig() (map[string]provider.NodeConfig, error) {
+	p.nodes.Lock()
+	defer p.nodes.Unlock()
+	return p.nodes.config, nil
+}
+
 // TaskArnToNodeID transforms a TaskArn to a node id
 func TaskArnToNodeID(arn string) (string, error) {
 	parts := strings.Split(arn, "task/")
@@ -94,8 +115,8 @@ func TaskArnToNodeID(arn string) (string, error) {
 	return parts[1], nil
 }
 
-func (p Provider) findEndpoints(task *ecs.Task, taskdef *ecs.TaskDefinition) (map[string][]provider.Endpoint, error) {
-	services := make(map[string][]provider.Endpoint)
+func (p Provider) findClusters(task *ecs.Task, taskdef *ecs.TaskDefinition) (map[string]provider.Cluster, error) {
+	services := make(map[string]provider.Cluster)
 	log.Infof("finding endpoints for task %#v", *task)
 	taskTargets, err := findTaskTargets(taskdef)
 	if err != nil {
@@ -105,13 +126,17 @@ func (p Provider) findEndpoints(task *ecs.Task, taskdef *ecs.TaskDefinition) (ma
 	for _, container := range task.Containers {
 		if taskTargets[*container.Name] != nil {
 			for _, target := range taskTargets[*container.Name] {
+				cluster := services[target.ClusterName]
+				cluster.Name = target.ClusterName
+				cluster.Routes = target.Routes
 				for _, nic := range container.NetworkInterfaces {
-					services[target.ClusterName] = append(services[target.ClusterName], provider.Endpoint{
+					cluster.Endpoints = append(cluster.Endpoints, provider.Endpoint{
 						Address:     *nic.PrivateIpv4Address,
 						Annotations: target.Annotations,
 						Port:        target.Port,
 					})
 				}
+				services[target.ClusterName] = cluster
 			}
 		}
 	}
@@ -122,6 +147,7 @@ func (p Provider) findEndpoints(task *ecs.Task, taskdef *ecs.TaskDefinition) (ma
 type taskTarget struct {
 	ClusterName string
 	Annotations map[string]string
+	Routes      []provider.RouteRule
 	Port        uint32
 }
 
@@ -131,11 +157,10 @@ func findTaskTargets(task *ecs.TaskDefinition) (map[string][]taskTarget, error)
 	for _, container := range task.ContainerDefinitions {
 		for label, value := range container.DockerLabels {
 			// FIXME: properly validate labels
-			//        envoy.service.foo.bar.annotations.baz.bang = foo:123
-			//        -> this would create a service foo.bar.annotations.baz.bang
-			//           that points to container "foo" at port "123"
+			//        service names must not contain .annotations. or .routes.
 			clusterName := strings.TrimPrefix(label, "envoy.service.")
-			if label == clusterName {
+			if label == clusterName || strings.Contains(clusterName, ".annotations.") ||
+				strings.Contains(clusterName, ".routes.") {
 				continue
 			}
 			list := strings.Split(*value, ":")
@@ -146,9 +171,14 @@ func findTaskTargets(task *ecs.TaskDefinition) (map[string][]taskTarget, error)
 			if err != nil {
 				continue
 			}
+			routes, err := provider.ParseRouteRules(stripKeyPrefix(fmt.Sprintf("%s.routes.", label), container.DockerLabels))
+			if err != nil {
+				log.Warnf("error parsing routes of service %s: %s", clusterName, err)
+			}
 			targets[list[0]] = append(targets[list[0]], taskTarget{
 				ClusterName: clusterName,
 				Annotations: stripKeyPrefix(fmt.Sprintf("%s.annotations.", label), container.DockerLabels),
+				Routes:      routes,
 				Port:        uint32(port),
 			})
 		}
@@ -156,6 +186,54 @@ func findTaskTargets(task *ecs.TaskDefinition) (map[string][]taskTarget, error)
 	return targets, nil
 }
 
+// findNodeConfig parses the node labels of all containers
+// envoy.node.dependencies: a comma-separated list of services
+// envoy.node.accesslog.*: the access log config
+// envoy.node.listener.*: the listener ports
+// envoy.node.bind.<service>: a service binding
+// an invalid label is logged and skipped, the other labels still apply
+func findNodeConfig(task *ecs.TaskDefinition) provider.NodeConfig {
+	var cfg provider.NodeConfig
+	for _, container := range task.ContainerDefinitions {
+		if value, ok := container.DockerLabels["envoy.node.dependencies"]; ok {
+			for _, dep := range strings.Split(*value, ",") {
+				dep = strings.TrimSpace(dep)
+				if dep != "" {
+					cfg.Dependencies = append(cfg.Dependencies, dep)
+				}
+			}
+		}
+		accessLog, err := provider.ParseAccessLogConfig(stripKeyPrefix("envoy.node.accesslog.", container.DockerLabels))
+		if err != nil {
+			log.Warnf("error parsing access log config of %s: %s", *container.Name, err)
+		} else if accessLog != nil {
+			cfg.AccessLog = accessLog
+		}
+		listeners, err := provider.ParseListenerPortsConfig(stripKeyPrefix("envoy.node.listener.", container.DockerLabels))
+		if err != nil {
+			log.Warnf("error parsing listener config of %s: %s", *container.Name, err)
+		} else if listeners != nil {
+			cfg.Listeners = listeners
+		}
+		// every binding is parsed on its own, an invalid one doesn't drop the others
+		labels := stripKeyPrefix("envoy.node.bind.", container.DockerLabels)
+		var services []string
+		for service := range labels {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		for _, service := range services {
+			bindings, err := provider.ParseServiceBindings(map[string]string{service: labels[service]})
+			if err != nil {
+				log.Warnf("error parsing binding of %s: %s", *container.Name, err)
+				continue
+			}
+			cfg.Bindings = append(cfg.Bindings, bindings...)
+		}
+	}
+	return cfg
+}
+
 // stripKeyPrefix removes the prefixes from all keys in the labels map
 // if a key don't have a prefix they're being ejected
 func stripKeyPrefix(prefix string, labels map[string]*string) map[string]string {
@@ -14,7 +14,10 @@ type Provider struct {
 }
 
 type schema struct {
-	Nodes map[string][]provider.Cluster `yaml:"nodes"`
+	Mesh       provider.MeshConfig            `yaml:"mesh"`
+	Services   []provider.Cluster             `yaml:"services"`
+	NodeConfig map[string]provider.NodeConfig `yaml:"nodeConfig"`
+	Nodes      map[string][]provider.Cluster  `yaml:"nodes"`
 }
 
 // NewProvider returns a new file provider
@@ -43,3 +46,30 @@ func (p Provider) GetClusters() (nodes map[string][]provider.Cluster, err error)
 	}
 	return cfg.Nodes, err
 }
+
+// GetMeshConfig implements the provider.MeshConfigProvider interface
+func (p Provider) GetMeshConfig() (provider.MeshConfig, error) {
+	cfg, err := readConfig(p.path)
+	if err != nil {
+		return provider.MeshConfig{}, err
+	}
+	return cfg.Mesh, nil
+}
+
+// GetNodeConfig implements the provider.NodeConfigProvider interface
+func (p Provider) GetNodeConfig() (map[string]provider.NodeConfig, error) {
+	cfg, err := readConfig(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.NodeConfig, nil
+}
+
+// GetGlobalServices implements the provider.GlobalServiceProvider interface
+func (p Provider) GetGlobalServices() ([]provider.Cluster, error) {
+	cfg, err := readConfig(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Services, nil
+}
@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/moolen/bent/envoy/api/v2/route"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultIngressGatewayTLSPort = 4443
+
+// IngressGatewayConfig configures an ingress gateway node
+// only the services which are mapped by the routes are reachable
+type IngressGatewayConfig struct {
+	// Node specifies the envoy node id of the gateway
+	Node string `yaml:"node"`
+	// Port specifies the plaintext listener port, defaults to 4100
+	Port uint32 `yaml:"port"`
+	// TLSPort specifies the TLS listener port, defaults to 4443
+	// the TLS listener is only created if there are certificates
+	TLSPort uint32 `yaml:"tlsPort"`
+	// Plaintext keeps the plaintext listener next to the TLS listener
+	// gateways without certificates always listen in plaintext
+	Plaintext bool `yaml:"plaintext"`
+	// Certificates are selected by the SNI host of the client
+	Certificates []TLSCertificateConfig `yaml:"certificates"`
+	// Routes map public hostnames and path prefixes to services
+	Routes []IngressRoute `yaml:"routes"`
+}
+
+// IngressRoute maps a public hostname and path prefix to a service
+type IngressRoute struct {
+	// Host specifies the public hostname, "*" matches all hosts
+	Host string `yaml:"host"`
+	// PathPrefix defaults to "/"
+	PathPrefix string `yaml:"pathPrefix"`
+	// Service specifies the mesh service which receives the requests
+	Service string `yaml:"service"`
+	// PrefixRewrite replaces the path prefix before the request is forwarded
+	PrefixRewrite string `yaml:"prefixRewrite"`
+}
+
+// Validate returns an error if the gateway can not be used
+func (g IngressGatewayConfig) Validate() error {
+	if g.Node == "" {
+		return fmt.Errorf("missing ingress gateway node")
+	}
+	for i, cert := range g.Certificates {
+		if err := cert.Validate(); err != nil {
+			return fmt.Errorf("invalid certificate %d of %s: %s", i, g.Node, err)
+		}
+	}
+	return nil
+}
+
+func (g IngressGatewayConfig) port() uint32 {
+	if g.Port == 0 {
+		return defaultIngressTrafficPort
+	}
+	return g.Port
+}
+
+// plaintext returns true if the gateway accepts plaintext requests
+func (g IngressGatewayConfig) plaintext() bool {
+	return g.Plaintext || len(g.Certificates) == 0
+}
+
+func (g IngressGatewayConfig) tlsPort() uint32 {
+	if g.TLSPort == 0 {
+		return defaultIngressGatewayTLSPort
+	}
+	return g.TLSPort
+}
+
+func (r IngressRoute) pathPrefix() string {
+	if r.PathPrefix == "" {
+		return "/"
+	}
+	return r.PathPrefix
+}
+
+// exposedServices returns the known services which are mapped by the routes
+func (g IngressGatewayConfig) exposedServices(services map[string]ClusterConfig) map[string]struct{} {
+	exposed := make(map[string]struct{})
+	for _, r := range g.Routes {
+		if _, ok := services[r.Service]; ok {
+			exposed[r.Service] = struct{}{}
+		}
+	}
+	return exposed
+}
+
+// createIngressGatewayVHosts returns a vhost per public hostname
+// the routes of a vhost are ordered by prefix length, longest first
+// routes to unknown services are skipped
+func createIngressGatewayVHosts(g IngressGatewayConfig, services map[string]ClusterConfig) []route.VirtualHost {
+	hostRoutes := make(map[string][]IngressRoute)
+	for i, r := range g.Routes {
+		if r.Host == "" {
+			log.Warnf("skipping route %d of ingress gateway %s: missing host", i, g.Node)
+			continue
+		}
+		if _, ok := services[r.Service]; !ok {
+			log.Warnf("skipping route %d of ingress gateway %s: unknown service %s", i, g.Node, r.Service)
+			continue
+		}
+		hostRoutes[r.Host] = append(hostRoutes[r.Host], r)
+	}
+	var hosts []string
+	for host := range hostRoutes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var vhosts []route.VirtualHost
+	for _, host := range hosts {
+		routes := hostRoutes[host]
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].pathPrefix()) > len(routes[j].pathPrefix())
+		})
+		domains := []string{host}
+		if host != "*" {
+			if g.plaintext() {
+				domains = append(domains, fmt.Sprintf("%s:%d", host, g.port()))
+			}
+			if len(g.Certificates) > 0 {
+				domains = append(domains, fmt.Sprintf("%s:%d", host, g.tlsPort()))
+			}
+		}
+		vhost := route.VirtualHost{
+			Name:    fmt.Sprintf("vhost_%s", host),
+			Domains: domains,
+		}
+		for _, r := range routes {
+			cfg := services[r.Service]
+			// the sidecar of the service routes by the host header
+			action := createRouteAction(VHostConfig{
+				Hostname:    r.Service,
+				Cluster:     r.Service,
+				Config:      cfg,
+				Split:       cfg.TrafficSplit,
+				Mirror:      cfg.Mirror,
+				HostRewrite: r.Service,
+			})
+			action.PrefixRewrite = r.PrefixRewrite
+			vhost.Routes = append(vhost.Routes, route.Route{
+				Match: route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_Prefix{
+						Prefix: r.pathPrefix(),
+					},
+				},
+				Action: &route.Route_Route{
+					Route: action,
+				},
+			})
+		}
+		vhosts = append(vhosts, vhost)
+	}
+	return vhosts
+}
@@ -2,22 +2,24 @@ package provider
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gogo/protobuf/types"
 	google_protobuf "github.com/gogo/protobuf/types"
 	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/auth"
 	"github.com/moolen/bent/envoy/api/v2/core"
 	"github.com/moolen/bent/envoy/api/v2/listener"
 	"github.com/moolen/bent/envoy/api/v2/route"
-	accesslog "github.com/moolen/bent/envoy/config/accesslog/v2"
-	v21 "github.com/moolen/bent/envoy/config/filter/accesslog/v2"
 	filterfault "github.com/moolen/bent/envoy/config/filter/fault/v2"
 	authz "github.com/moolen/bent/envoy/config/filter/http/ext_authz/v2"
 	fault "github.com/moolen/bent/envoy/config/filter/http/fault/v2"
 	hc "github.com/moolen/bent/envoy/config/filter/http/health_check/v2"
 	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
 	_type "github.com/moolen/bent/envoy/type"
+	"github.com/moolen/bent/envoy/type/matcher"
 	"github.com/moolen/bent/pkg/util"
 )
 
@@ -39,11 +41,58 @@ type ListenerConfig struct {
 	Address string
 	// Port specifies the port the listener listens on
 	Port uint32
+	// AccessLog specifies the access logging of the listener
+	AccessLog AccessLogConfig
+	// Tracing specifies the sampling and tagging of the spans
+	Tracing TracingConfig
+	// TLS terminates TLS, the certificate is selected by the SNI host
+	TLS []TLSCertificateConfig
+}
+
+// TLSCertificateConfig defines a certificate which is served to the clients
+type TLSCertificateConfig struct {
+	// Hosts specifies the SNI hostnames of the certificate
+	// it is used for all hosts if empty
+	Hosts []string `yaml:"hosts"`
+	// CertificateChain specifies the path of the PEM certificate chain
+	// in the envoy container
+	CertificateChain string `yaml:"certificateChain"`
+	// PrivateKey specifies the path of the PEM private key
+	// in the envoy container
+	PrivateKey string `yaml:"privateKey"`
+}
+
+// Validate returns an error if the certificate is incomplete
+func (c TLSCertificateConfig) Validate() error {
+	if c.CertificateChain == "" || c.PrivateKey == "" {
+		return fmt.Errorf("missing certificate chain or private key")
+	}
+	return nil
 }
 
 // AuthzConfig defines the behavior of the Authz HTTP Filter
 type AuthzConfig struct {
-	Cluster string
+	// Cluster specifies the cluster of the authorization service
+	// it must be defined in the envoy bootstrap config
+	Cluster string `yaml:"cluster"`
+	// URI specifies the uri of the HTTP authorization service
+	// defaults to http://<cluster>
+	URI string `yaml:"uri"`
+	// GRPC uses the envoy gRPC authorization API instead of HTTP
+	GRPC bool `yaml:"grpc"`
+	// Timeout specifies the timeout of the authorization request, defaults to 125ms
+	Timeout time.Duration `yaml:"timeout"`
+	// FailureModeAllow accepts requests if the authorization service is unavailable
+	FailureModeAllow bool `yaml:"failureModeAllow"`
+	// AllowedRequestHeaders specifies the client headers which are sent
+	// to the HTTP authorization service
+	AllowedRequestHeaders []string `yaml:"allowedRequestHeaders"`
+	// AllowedResponseHeaders specifies the headers of the HTTP authorization response
+	// which are added to the upstream request
+	AllowedResponseHeaders []string `yaml:"allowedResponseHeaders"`
+	// Nodes specifies the nodes which have authz enabled on their ingress listener
+	// it may also be enabled per service using annotations
+	Nodes []string `yaml:"nodes"`
 }
 
 // FaultConfig defines the behavior of the fault HTTP filter
@@ -77,9 +126,47 @@ func NewListener(cfg ListenerConfig) *Listener {
 		},
 		hcm: createConnectionManager(cfg),
 	}
+	if len(cfg.TLS) > 0 {
+		lis.envoyListener.FilterChains = createTLSFilterChains(cfg.TLS)
+		lis.envoyListener.ListenerFilters = []listener.ListenerFilter{{
+			Name: util.TLSInspector,
+		}}
+	}
 	return lis
 }
 
+// createTLSFilterChains returns a filter chain per certificate
+func createTLSFilterChains(certs []TLSCertificateConfig) []listener.FilterChain {
+	var chains []listener.FilterChain
+	for _, cert := range certs {
+		chains = append(chains, listener.FilterChain{
+			FilterChainMatch: &listener.FilterChainMatch{
+				ServerNames: cert.Hosts,
+			},
+			TlsContext: &auth.DownstreamTlsContext{
+				CommonTlsContext: &auth.CommonTlsContext{
+					TlsCertificates: []*auth.TlsCertificate{
+						{
+							CertificateChain: &core.DataSource{
+								Specifier: &core.DataSource_Filename{
+									Filename: cert.CertificateChain,
+								},
+							},
+							PrivateKey: &core.DataSource{
+								Specifier: &core.DataSource_Filename{
+									Filename: cert.PrivateKey,
+								},
+							},
+						},
+					},
+				},
+			},
+			Filters: []listener.Filter{},
+		})
+	}
+	return chains
+}
+
 func createConnectionManager(cfg ListenerConfig) *hcm.HttpConnectionManager {
 	return &hcm.HttpConnectionManager{
 		CodecType:  hcm.AUTO,
@@ -88,20 +175,8 @@ func createConnectionManager(cfg ListenerConfig) *hcm.HttpConnectionManager {
 		HttpProtocolOptions: &core.Http1ProtocolOptions{
 			AllowAbsoluteUrl: &types.BoolValue{Value: true},
 		},
-		AccessLog: []*v21.AccessLog{{
-			Name: util.FileAccessLog,
-			ConfigType: &v21.AccessLog_TypedConfig{
-				TypedConfig: util.MessageToAny(&accesslog.FileAccessLog{
-					Path: "/tmp/access.log",
-					AccessLogFormat: &accesslog.FileAccessLog_JsonFormat{
-						JsonFormat: jsonLog,
-					},
-				}),
-			},
-		}},
-		Tracing: &hcm.HttpConnectionManager_Tracing{
-			OperationName: cfg.TracingOperation,
-		},
+		AccessLog: createAccessLogs(cfg.AccessLog, cfg.TargetRoute),
+		Tracing:   createTracing(cfg.TracingOperation, cfg.Tracing),
 		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
 			Rds: &hcm.Rds{
 				RouteConfigName: cfg.TargetRoute,
@@ -178,71 +253,200 @@ func (l Listener) InjectFault(cfg FaultConfig) {
 // order matters!
 func (l Listener) InjectAuthz(cfg AuthzConfig) {
 	timeout := time.Millisecond * 125
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+
+	extAuthz := &authz.ExtAuthz{
+		FailureModeAllow: cfg.FailureModeAllow,
+	}
+	if cfg.GRPC {
+		extAuthz.Services = &authz.ExtAuthz_GrpcService{
+			GrpcService: &core.GrpcService{
+				Timeout: &timeout,
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: cfg.Cluster,
+					},
+				},
+			},
+		}
+	} else {
+		uri := cfg.URI
+		if uri == "" {
+			uri = fmt.Sprintf("http://%s", cfg.Cluster)
+		}
+		extAuthz.Services = &authz.ExtAuthz_HttpService{
+			HttpService: &authz.HttpService{
+				ServerUri: &core.HttpUri{
+					Uri:     uri,
+					Timeout: &timeout,
+					HttpUpstreamType: &core.HttpUri_Cluster{
+						Cluster: cfg.Cluster,
+					},
+				},
+				AuthorizationRequest: &authz.AuthorizationRequest{
+					AllowedHeaders: createListStringMatcher(cfg.AllowedRequestHeaders),
+				},
+				AuthorizationResponse: &authz.AuthorizationResponse{
+					AllowedUpstreamHeaders: createListStringMatcher(cfg.AllowedResponseHeaders),
+				},
+			},
+		}
+	}
+
 	l.hcm.HttpFilters = append([]*hcm.HttpFilter{{
 		Name: util.HTTPExternalAuthorization,
 		ConfigType: &hcm.HttpFilter_TypedConfig{
-			TypedConfig: util.MessageToAny(&authz.ExtAuthz{
-				FailureModeAllow: false,
-				Services: &authz.ExtAuthz_HttpService{
-					HttpService: &authz.HttpService{
-						ServerUri: &core.HttpUri{
-							Uri:     "http://authfoo:3000/authenticate",
-							Timeout: &timeout,
-							HttpUpstreamType: &core.HttpUri_Cluster{
-								Cluster: cfg.Cluster,
-							},
-						},
-					},
-				},
-			}),
+			TypedConfig: util.MessageToAny(extAuthz),
 		},
 	}}, l.hcm.HttpFilters...)
 }
 
-// InjectHealthCheckCache prependas a http health check cache into the http filter chain
+// createListStringMatcher returns nil if the list is empty
+func createListStringMatcher(list []string) *matcher.ListStringMatcher {
+	if len(list) == 0 {
+		return nil
+	}
+	m := &matcher.ListStringMatcher{}
+	for _, val := range list {
+		m.Patterns = append(m.Patterns, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{
+				Exact: val,
+			},
+		})
+	}
+	return m
+}
+
+// InjectGRPCStats prepends the gRPC HTTP/1.1 bridge filter into the http filter chain.
+// Besides bridging, it collects the per-method stats of all gRPC requests
 // order matters!
-func (l Listener) InjectHealthCheckCache(cluster Cluster) {
-	cfg := cluster.Config()
-	//cacheTime := time.Second * 30
+func (l Listener) InjectGRPCStats() {
 	l.hcm.HttpFilters = append([]*hcm.HttpFilter{{
-		Name: util.HealthCheck,
-		ConfigType: &hcm.HttpFilter_TypedConfig{
-			TypedConfig: util.MessageToAny(&hc.HealthCheck{
-				// TODO: implement pass-through-less caching:
-				// https://www.envoyproxy.io/docs/envoy/latest/api-v2/config/filter/http/health_check/v2/health_check.proto
+		Name: util.GRPCHTTP1Bridge,
+	}}, l.hcm.HttpFilters...)
+}
+
+// InjectHealthCheck prepends the http health check filters into the http filter chain.
+// Health checks which are passed through to the services are cached, services
+// with the same health check path and cache duration share a single filter.
+// Health checks of services which respond locally are answered by envoy
+// based on the healthy hosts of their local cluster: a filter reports the health
+// of all clusters it lists, so every one of these services needs its own filter.
+// order matters!
+func (l Listener) InjectHealthCheck(clusters []Cluster) {
+	var passThrough []*passThroughHealthCheck
+	var respond []*hcm.HttpFilter
+	for _, cluster := range clusters {
+		cfg := cluster.Config()
+		// the filter only applies to HTTP health checks
+		if cfg.HealthCheck.Disabled || cfg.HealthCheck.Type != healthCheckHTTP {
+			continue
+		}
+		if cfg.HealthCheck.Respond {
+			respond = append(respond, createHealthCheckFilter(&hc.HealthCheck{
 				PassThroughMode: &types.BoolValue{
-					Value: true,
+					Value: false,
 				},
-				CacheTime: &cfg.HealthCheck.CacheDuration,
-				Headers: []*route.HeaderMatcher{
-					{
-						Name: ":path",
-						HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
-							ExactMatch: cfg.HealthCheck.Path,
-						},
+				ClusterMinHealthyPercentages: map[string]*_type.Percent{
+					localClusterName(cluster.Name): {
+						Value: float64(cfg.HealthCheck.MinHealthyPercent),
 					},
 				},
-			}),
+				Headers: createHealthCheckMatchers([]string{cluster.Name}, cfg.HealthCheck.Path),
+			}))
+			continue
+		}
+		var group *passThroughHealthCheck
+		for _, g := range passThrough {
+			if g.path == cfg.HealthCheck.Path && g.cache == cfg.HealthCheck.CacheDuration {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &passThroughHealthCheck{path: cfg.HealthCheck.Path, cache: cfg.HealthCheck.CacheDuration}
+			passThrough = append(passThrough, group)
+		}
+		group.services = append(group.services, cluster.Name)
+	}
+	var filters []*hcm.HttpFilter
+	for _, g := range passThrough {
+		filters = append(filters, createHealthCheckFilter(&hc.HealthCheck{
+			PassThroughMode: &types.BoolValue{
+				Value: true,
+			},
+			CacheTime: &g.cache,
+			Headers:   createHealthCheckMatchers(g.services, g.path),
+		}))
+	}
+	filters = append(filters, respond...)
+	l.hcm.HttpFilters = append(filters, l.hcm.HttpFilters...)
+}
+
+// passThroughHealthCheck holds the services whose health checks share a filter
+type passThroughHealthCheck struct {
+	path     string
+	cache    time.Duration
+	services []string
+}
+
+func createHealthCheckFilter(cfg *hc.HealthCheck) *hcm.HttpFilter {
+	return &hcm.HttpFilter{
+		Name: util.HealthCheck,
+		ConfigType: &hcm.HttpFilter_TypedConfig{
+			TypedConfig: util.MessageToAny(cfg),
 		},
-	}}, l.hcm.HttpFilters...)
+	}
+}
+
+// createHealthCheckMatchers matches the health checks of the services
+// the peers send them with the service as host
+func createHealthCheckMatchers(services []string, path string) []*route.HeaderMatcher {
+	hosts := make([]string, len(services))
+	for i, service := range services {
+		hosts[i] = regexp.QuoteMeta(service)
+	}
+	host := hosts[0]
+	if len(hosts) > 1 {
+		host = fmt.Sprintf("(%s)", strings.Join(hosts, "|"))
+	}
+	return []*route.HeaderMatcher{
+		{
+			Name: ":authority",
+			HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{
+				RegexMatch: fmt.Sprintf("%s(:[0-9]+)?", host),
+			},
+		},
+		{
+			Name: ":path",
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+				ExactMatch: path,
+			},
+		},
+	}
 }
 
 // Resource builds and returns the envoy v2.listener
 func (l Listener) Resource() *v2.Listener {
 	// for now, reset filters when using this func multiple times
-	l.envoyListener.FilterChains[0].Filters = []listener.Filter{}
+	// convert hcm & append it to the filter chains
+	for i := range l.envoyListener.FilterChains {
+		l.envoyListener.FilterChains[i].Filters = []listener.Filter{l.connectionManagerFilter()}
+	}
+	return l.envoyListener
+}
 
-	// convert hcm & append it to the filter chain
-	l.envoyListener.FilterChains[0].Filters = append(
-		l.envoyListener.FilterChains[0].Filters,
-		listener.Filter{
-			Name: util.HTTPConnectionManager,
-			ConfigType: &listener.Filter_TypedConfig{
-				TypedConfig: util.MessageToAny(l.hcm),
-			},
+// connectionManagerFilter returns the http connection manager
+// as network filter
+func (l Listener) connectionManagerFilter() listener.Filter {
+	return listener.Filter{
+		Name: util.HTTPConnectionManager,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: util.MessageToAny(l.hcm),
 		},
-	)
-	return l.envoyListener
+	}
 }
 
 var (
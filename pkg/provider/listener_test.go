@@ -7,7 +7,10 @@ import (
 	"github.com/gogo/protobuf/types"
 	"github.com/moolen/bent/envoy/api/v2/core"
 	"github.com/moolen/bent/envoy/api/v2/listener"
+	authz "github.com/moolen/bent/envoy/config/filter/http/ext_authz/v2"
+	hc "github.com/moolen/bent/envoy/config/filter/http/health_check/v2"
 	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/moolen/bent/envoy/type/matcher"
 	"github.com/moolen/bent/pkg/util"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
@@ -91,3 +94,123 @@ func getHTTPFilters(f listener.Filter) ([]*hcm.HttpFilter, error) {
 	}
 	return hcm.HttpFilters, nil
 }
+
+func TestListenerAuthz(t *testing.T) {
+	l := NewListener(ListenerConfig{
+		Name:        "ingress",
+		Address:     "0.0.0.0",
+		Port:        4100,
+		TargetRoute: "myroute",
+	})
+	l.InjectAuthz(AuthzConfig{
+		Cluster:               "authz",
+		URI:                   "http://authz:8080",
+		Timeout:               time.Second,
+		FailureModeAllow:      true,
+		AllowedRequestHeaders: []string{"authorization"},
+	})
+	filters, err := getHTTPFilters(l.Resource().FilterChains[0].Filters[0])
+	assert.NilError(t, err)
+	assertHTTPFilters(t, filters, util.HTTPExternalAuthorization, util.Router)
+
+	var extAuthz authz.ExtAuthz
+	assert.NilError(t, types.UnmarshalAny(filters[0].ConfigType.(*hcm.HttpFilter_TypedConfig).TypedConfig, &extAuthz))
+	assert.Equal(t, extAuthz.FailureModeAllow, true)
+	httpService := extAuthz.Services.(*authz.ExtAuthz_HttpService).HttpService
+	assert.Equal(t, httpService.ServerUri.Uri, "http://authz:8080")
+	assert.Equal(t, *httpService.ServerUri.Timeout, time.Second)
+	assert.Equal(t, httpService.AuthorizationRequest.AllowedHeaders.Patterns[0].MatchPattern.(*matcher.StringMatcher_Exact).Exact, "authorization")
+
+	l = NewListener(ListenerConfig{
+		Name:        "ingress",
+		Address:     "0.0.0.0",
+		Port:        4100,
+		TargetRoute: "myroute",
+	})
+	l.InjectAuthz(AuthzConfig{
+		Cluster: "authz",
+		GRPC:    true,
+	})
+	filters, err = getHTTPFilters(l.Resource().FilterChains[0].Filters[0])
+	assert.NilError(t, err)
+	assert.NilError(t, types.UnmarshalAny(filters[0].ConfigType.(*hcm.HttpFilter_TypedConfig).TypedConfig, &extAuthz))
+	grpcService := extAuthz.Services.(*authz.ExtAuthz_GrpcService).GrpcService
+	assert.Equal(t, grpcService.TargetSpecifier.(*core.GrpcService_EnvoyGrpc_).EnvoyGrpc.ClusterName, "authz")
+	assert.Equal(t, *grpcService.Timeout, time.Millisecond*125)
+}
+
+func TestListenerHealthCheck(t *testing.T) {
+	l := NewListener(ListenerConfig{
+		Name:        "ingress",
+		Address:     "0.0.0.0",
+		Port:        defaultIngressTrafficPort,
+		TargetRoute: ingressRoute,
+	})
+	l.InjectHealthCheck([]Cluster{
+		{
+			Name: "alpha.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312, Annotations: map[string]string{
+				AnnotationHealthCacheDuration: "5000",
+			}}},
+		},
+		{
+			Name: "beta.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1313, Annotations: map[string]string{
+				AnnotationHealthCheckPath: "/status",
+			}}},
+		},
+		{
+			Name: "gamma.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1314, Annotations: map[string]string{
+				AnnotationHealthRespond:           "",
+				AnnotationHealthMinHealthyPercent: "50",
+			}}},
+		},
+		{
+			// no HTTP health check: no filter
+			Name: "delta.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1315, Annotations: map[string]string{
+				AnnotationHealthType:    "tcp",
+				AnnotationHealthRespond: "",
+			}}},
+		},
+		{
+			Name: "epsilon.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1316, Annotations: map[string]string{
+				AnnotationHealthCacheDuration: "5000",
+			}}},
+		},
+	})
+	res := l.Resource()
+	filters, err := getHTTPFilters(res.FilterChains[0].Filters[0])
+	assert.NilError(t, err)
+	assert.Equal(t, filters[len(filters)-1].Name, util.Router)
+
+	// every service is matched by its host and health check path
+	checks := make(map[string]hc.HealthCheck)
+	for _, filter := range filters[:len(filters)-1] {
+		assert.Equal(t, filter.Name, util.HealthCheck)
+		var check hc.HealthCheck
+		assert.NilError(t, types.UnmarshalAny(filter.ConfigType.(*hcm.HttpFilter_TypedConfig).TypedConfig, &check))
+		assert.Equal(t, check.Headers[0].Name, ":authority")
+		checks[check.Headers[0].GetRegexMatch()] = check
+	}
+	assert.Assert(t, is.Len(checks, 3))
+
+	// pass-through checks with the same path and cache duration share a filter
+	cached := checks[`(alpha\.svc|epsilon\.svc)(:[0-9]+)?`]
+	assert.Equal(t, cached.PassThroughMode.Value, true)
+	assert.Equal(t, *cached.CacheTime, time.Second*5)
+	assert.Equal(t, cached.Headers[1].GetExactMatch(), defaultHealthCheckPath)
+
+	beta := checks[`beta\.svc(:[0-9]+)?`]
+	assert.Equal(t, *beta.CacheTime, time.Millisecond*defaultHealthCacheDuration)
+	assert.Equal(t, beta.Headers[1].GetExactMatch(), "/status")
+
+	// local responses only report the health of the service itself
+	local := checks[`gamma\.svc(:[0-9]+)?`]
+	assert.Equal(t, local.PassThroughMode.Value, false)
+	assert.Assert(t, local.CacheTime == nil)
+	assert.Assert(t, is.Len(local.ClusterMinHealthyPercentages, 1))
+	assert.Equal(t, local.ClusterMinHealthyPercentages["local_gamma.svc"].Value, 50.0)
+}
@@ -0,0 +1,160 @@
+package provider
+
+import log "github.com/sirupsen/logrus"
+
+// MeshConfigProvider is implemented by providers which supply
+// settings that apply to the whole mesh
+type MeshConfigProvider interface {
+	// GetMeshConfig returns the current mesh config
+	GetMeshConfig() (MeshConfig, error)
+}
+
+// NodeConfigProvider is implemented by providers which supply
+// settings of individual nodes
+type NodeConfigProvider interface {
+	// GetNodeConfig returns the config per node
+	GetNodeConfig() (map[string]NodeConfig, error)
+}
+
+// GlobalServiceProvider is implemented by providers which supply
+// services that are not tied to a node, e.g. endpoints outside of the mesh
+type GlobalServiceProvider interface {
+	// GetGlobalServices returns the services which may be called by the nodes
+	GetGlobalServices() ([]Cluster, error)
+}
+
+// NodeConfig defines the behavior of a single node
+// the zero value is a valid config
+type NodeConfig struct {
+	// Dependencies are the services which the node may call
+	// * allows all services
+	Dependencies []string `yaml:"dependencies"`
+	// AccessLog overrides the access log config of the mesh
+	// it applies to all services of the node, there is no override per service
+	AccessLog *AccessLogConfig `yaml:"accessLog"`
+	// Listeners overrides the listener ports of the mesh
+	Listeners *ListenerPortsConfig `yaml:"listeners"`
+	// Bindings bind dependencies to dedicated ports
+	Bindings []ServiceBinding `yaml:"bindings"`
+}
+
+const allDependencies = "*"
+
+// MeshConfig defines the mesh-wide behavior
+// the zero value is a valid config
+type MeshConfig struct {
+	// Authz configures the external authorization service
+	// authz is disabled if nil
+	Authz *AuthzConfig `yaml:"authz"`
+	// RBAC configures the service-to-service authorization policies
+	// rbac is disabled if nil
+	RBAC *RBACConfig `yaml:"rbac"`
+	// AllowAllByDefault allows nodes which do not declare
+	// their dependencies to call all services
+	AllowAllByDefault bool `yaml:"allowAllByDefault"`
+	// AccessLog configures the access logging of all nodes
+	// defaults to JSON logs in /tmp/access.log
+	AccessLog *AccessLogConfig `yaml:"accessLog"`
+	// Tracing specifies the sampling and tagging defaults
+	// the services may override them using annotations
+	Tracing *TracingConfig `yaml:"tracing"`
+	// ExternalServices are services outside of the mesh
+	// the nodes call them like mesh services
+	ExternalServices []ExternalService `yaml:"externalServices"`
+	// EgressGateway routes the requests to external services through a gateway
+	// the sidecars call external services directly if nil
+	EgressGateway *EgressGatewayConfig `yaml:"egressGateway"`
+	// IngressGateways replace the default "ingress" node
+	// which exposes all services under their mesh names
+	IngressGateways []IngressGatewayConfig `yaml:"ingressGateways"`
+	// Listeners specifies the listener ports of all sidecars
+	Listeners *ListenerPortsConfig `yaml:"listeners"`
+	// Transparent adds a catch-all listener for connections
+	// which are redirected by iptables, disabled if nil
+	Transparent *TransparentConfig `yaml:"transparent"`
+}
+
+// egressGateway returns nil if the egress gateway is disabled or invalid
+func (m MeshConfig) egressGateway() *EgressGatewayConfig {
+	if m.EgressGateway == nil {
+		return nil
+	}
+	if err := m.EgressGateway.Validate(); err != nil {
+		log.Warnf("egress gateway disabled: %s", err)
+		return nil
+	}
+	return m.EgressGateway
+}
+
+// externalServices returns the valid external services by name
+// external services must not shadow mesh services
+func (m MeshConfig) externalServices(services map[string]struct{}) map[string]ExternalService {
+	external := make(map[string]ExternalService)
+	for _, svc := range m.ExternalServices {
+		if err := svc.Validate(); err != nil {
+			log.Warnf("invalid external service: %s", err)
+			continue
+		}
+		if _, ok := services[svc.name()]; ok {
+			log.Warnf("external service %s conflicts with a mesh service", svc.name())
+			continue
+		}
+		if _, ok := external[svc.name()]; ok {
+			log.Warnf("duplicate external service %s", svc.name())
+			continue
+		}
+		external[svc.name()] = svc
+	}
+	return external
+}
+
+// dependencies returns the services which a node may call
+// unknown services are omitted
+func (m MeshConfig) dependencies(cfg NodeConfig, services map[string]struct{}) map[string]struct{} {
+	deps := make(map[string]struct{})
+	all := cfg.Dependencies == nil && m.AllowAllByDefault
+	for _, dep := range cfg.Dependencies {
+		if dep == allDependencies {
+			all = true
+			break
+		}
+		if _, ok := services[dep]; ok {
+			deps[dep] = struct{}{}
+		}
+	}
+	if all {
+		return services
+	}
+	return deps
+}
+
+// authzEnabled returns true if authz should be injected
+// into the ingress listener of the node
+func (m MeshConfig) authzEnabled(node string, clusters []Cluster) bool {
+	if m.Authz == nil {
+		return false
+	}
+	for _, name := range m.Authz.Nodes {
+		if name == node {
+			return true
+		}
+	}
+	for _, cluster := range clusters {
+		if cluster.Config().Authz.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// authzExempt returns the exact paths and the path prefixes of a service
+// which are not subject to authorization
+func (m MeshConfig) authzExempt(cfg ClusterConfig) (paths []string, prefixes []string) {
+	if m.Authz == nil {
+		return nil, nil
+	}
+	if path := cfg.HealthCheck.requestPath(); path != "" {
+		paths = []string{path}
+	}
+	return paths, cfg.Authz.DisabledPaths
+}
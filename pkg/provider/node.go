@@ -2,7 +2,8 @@ package provider
 
 import (
 	"fmt"
-	"time"
+	"sort"
+	"strings"
 
 	"github.com/gogo/protobuf/types"
 	"github.com/moolen/bent/envoy/api/v2"
@@ -94,6 +95,27 @@ func (n *Node) AddRoute(routeName string, vhosts ...route.VirtualHost) {
 	}
 }
 
+// AddEnvoyCluster adds clusters which don't use EDS, e.g. DNS clusters
+func (n *Node) AddEnvoyCluster(clusters ...*v2.Cluster) {
+	for _, c := range clusters {
+		if n.clusters[c.Name] == nil {
+			n.clusters[c.Name] = c
+		}
+	}
+}
+
+// AddRouteHeaders adds headers to all requests which match the route config
+// the route config must exist
+func (n *Node) AddRouteHeaders(routeName string, headers ...*core.HeaderValueOption) {
+	if n.routes[routeName] == nil {
+		return
+	}
+	n.routes[routeName].RequestHeadersToAdd = append(
+		n.routes[routeName].RequestHeadersToAdd,
+		headers...,
+	)
+}
+
 func createEnvoyEndpoint(endpoints []Endpoint) []endpoint.LbEndpoint {
 	var envoyEndpoints []endpoint.LbEndpoint
 
@@ -126,11 +148,6 @@ func createEnvoyEndpoint(endpoints []Endpoint) []endpoint.LbEndpoint {
 func createEnvoyCluster(c Cluster) *v2.Cluster {
 	clusterCfg := c.Config()
 	log.Debugf("cluster config: %#v", clusterCfg)
-	// if nil, the endpoint port is used
-	var healthCheckPort *types.UInt32Value
-	if clusterCfg.HealthCheck.Port != 0 {
-		healthCheckPort = &types.UInt32Value{Value: clusterCfg.HealthCheck.Port}
-	}
 
 	cb := &cluster.CircuitBreakers_Thresholds{
 		Priority:           core.RoutingPriority_DEFAULT,
@@ -140,37 +157,24 @@ func createEnvoyCluster(c Cluster) *v2.Cluster {
 		MaxRetries:         &types.UInt32Value{Value: clusterCfg.CircuitBreaker.MaxRetries},
 	}
 
+	// only the local clusters point to the service itself
+	healthCheck := clusterCfg.HealthCheck
+	if !strings.HasPrefix(c.Name, localClusterName("")) {
+		healthCheck = healthCheck.peer(versionClusterService(c.Name))
+	}
+
 	cluster := &v2.Cluster{
 		Name:            c.Name,
-		ConnectTimeout:  1 * time.Second,
+		ConnectTimeout:  clusterCfg.Timeout.Connect,
 		Type:            v2.Cluster_EDS,
 		DnsLookupFamily: v2.Cluster_V4_ONLY,
-		LbPolicy:        v2.Cluster_ROUND_ROBIN,
+		LbPolicy:        lbPolicies[clusterCfg.LoadBalancer.Policy],
 		CircuitBreakers: &cluster.CircuitBreakers{
 			Thresholds: []*cluster.CircuitBreakers_Thresholds{cb},
 		},
-		// TODO: implement od
-		// OutlierDetection: &cluster.OutlierDetection{},
-		HealthChecks: []*core.HealthCheck{
-			{
-				Timeout:            &clusterCfg.HealthCheck.Timeout,
-				Interval:           &clusterCfg.HealthCheck.Interval,
-				UnhealthyThreshold: &types.UInt32Value{Value: 3},
-				HealthyThreshold:   &types.UInt32Value{Value: 3},
-				AltPort:            healthCheckPort,
-				HealthChecker: &core.HealthCheck_HttpHealthCheck_{
-					HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
-						Path: clusterCfg.HealthCheck.Path,
-						ExpectedStatuses: []*_type.Int64Range{
-							{
-								Start: clusterCfg.HealthCheck.ExpectedStatusLower,
-								End:   clusterCfg.HealthCheck.ExpectedStatusUpper,
-							},
-						},
-					},
-				},
-			},
-		},
+		OutlierDetection:     createOutlierDetection(clusterCfg.Outlier),
+		HealthChecks:         createHealthChecks(healthCheck),
+		Http2ProtocolOptions: createHTTP2ProtocolOptions(clusterCfg),
 		EdsClusterConfig: &v2.Cluster_EdsClusterConfig{
 			EdsConfig: createXDSConfigSource(),
 		},
@@ -179,6 +183,125 @@ func createEnvoyCluster(c Cluster) *v2.Cluster {
 	return cluster
 }
 
+// createHTTP2ProtocolOptions returns nil if the upstream connections use HTTP/1.1
+func createHTTP2ProtocolOptions(cfg ClusterConfig) *core.Http2ProtocolOptions {
+	if !cfg.HTTP2() {
+		return nil
+	}
+	return &core.Http2ProtocolOptions{}
+}
+
+// createHealthChecks returns nil if health checking is disabled
+func createHealthChecks(cfg ClusterHealthCheckConfig) []*core.HealthCheck {
+	if cfg.Disabled {
+		return nil
+	}
+	// if nil, the endpoint port is used
+	var healthCheckPort *types.UInt32Value
+	if cfg.Port != 0 {
+		healthCheckPort = &types.UInt32Value{Value: cfg.Port}
+	}
+	check := &core.HealthCheck{
+		Timeout:            &cfg.Timeout,
+		Interval:           &cfg.Interval,
+		UnhealthyThreshold: &types.UInt32Value{Value: cfg.UnhealthyThreshold},
+		HealthyThreshold:   &types.UInt32Value{Value: cfg.HealthyThreshold},
+		AltPort:            healthCheckPort,
+	}
+	if cfg.IntervalJitter > 0 {
+		check.IntervalJitter = &cfg.IntervalJitter
+	}
+	if cfg.NoTrafficInterval > 0 {
+		check.NoTrafficInterval = &cfg.NoTrafficInterval
+	}
+
+	switch cfg.Type {
+	case healthCheckTCP:
+		tcp := &core.HealthCheck_TcpHealthCheck{}
+		if cfg.TCPSend != "" {
+			tcp.Send = createHealthCheckPayload(cfg.TCPSend)
+		}
+		for _, payload := range cfg.TCPReceive {
+			tcp.Receive = append(tcp.Receive, createHealthCheckPayload(payload))
+		}
+		check.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: tcp,
+		}
+	case healthCheckGRPC:
+		check.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{
+				ServiceName: cfg.GRPCService,
+			},
+		}
+	default:
+		http := &core.HealthCheck_HttpHealthCheck{
+			Host: cfg.Host,
+			Path: cfg.Path,
+			ExpectedStatuses: []*_type.Int64Range{
+				{
+					Start: cfg.ExpectedStatusLower,
+					End:   cfg.ExpectedStatusUpper,
+				},
+			},
+		}
+		var names []string
+		for name := range cfg.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			http.RequestHeadersToAdd = append(http.RequestHeadersToAdd, &core.HeaderValueOption{
+				Header: &core.HeaderValue{
+					Key:   name,
+					Value: cfg.Headers[name],
+				},
+			})
+		}
+		check.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: http,
+		}
+	}
+	return []*core.HealthCheck{check}
+}
+
+func createHealthCheckPayload(payload string) *core.HealthCheck_Payload {
+	return &core.HealthCheck_Payload{
+		Payload: &core.HealthCheck_Payload_Text{
+			Text: payload,
+		},
+	}
+}
+
+var lbPolicies = map[string]v2.Cluster_LbPolicy{
+	lbPolicyRoundRobin:   v2.Cluster_ROUND_ROBIN,
+	lbPolicyLeastRequest: v2.Cluster_LEAST_REQUEST,
+	lbPolicyRandom:       v2.Cluster_RANDOM,
+	lbPolicyRingHash:     v2.Cluster_RING_HASH,
+	lbPolicyMaglev:       v2.Cluster_MAGLEV,
+}
+
+// createOutlierDetection returns nil if outlier detection is disabled
+func createOutlierDetection(cfg ClusterOutlierConfig) *cluster.OutlierDetection {
+	if !cfg.Enabled {
+		return nil
+	}
+	od := &cluster.OutlierDetection{
+		Consecutive_5Xx:          &types.UInt32Value{Value: cfg.Consecutive5xx},
+		Interval:                 &cfg.Interval,
+		BaseEjectionTime:         &cfg.BaseEjectionTime,
+		MaxEjectionPercent:       &types.UInt32Value{Value: cfg.MaxEjectionPercent},
+		EnforcingSuccessRate:     &types.UInt32Value{Value: cfg.SuccessRateEnforcing},
+		SuccessRateMinimumHosts:  &types.UInt32Value{Value: cfg.SuccessRateMinimumHosts},
+		SuccessRateRequestVolume: &types.UInt32Value{Value: cfg.SuccessRateRequestVolume},
+		SuccessRateStdevFactor:   &types.UInt32Value{Value: cfg.SuccessRateStdevFactor},
+	}
+	if cfg.ConsecutiveGatewayErrors > 0 {
+		od.ConsecutiveGatewayFailure = &types.UInt32Value{Value: cfg.ConsecutiveGatewayErrors}
+		od.EnforcingConsecutiveGatewayFailure = &types.UInt32Value{Value: 100}
+	}
+	return od
+}
+
 func createXDSConfigSource() *core.ConfigSource {
 	return &core.ConfigSource{
 		ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
@@ -202,63 +325,212 @@ func createXDSConfigSource() *core.ConfigSource {
 type VHostConfig struct {
 	Hostname string
 	Cluster  string
+	// Config specifies the route behavior
+	Config ClusterConfig
+	// Rules are compiled into routes in front of the default route
+	Rules []RouteRule
+	// Rewrite enables the rewrites of the rules
+	// they must only be applied once on the way to the service
+	Rewrite bool
+	// Split splits the traffic between the version clusters of the service
+	// instead of sending it to Cluster
+	Split []VersionWeight
+	// Mirror specifies the service that receives a copy of the requests
+	// the cluster of the service must exist on the node
+	Mirror ClusterMirrorConfig
+	// AuthzExemptPaths and AuthzExemptPrefixes specify the exact paths and
+	// the path prefixes which are not subject to authorization
+	AuthzExemptPaths    []string
+	AuthzExemptPrefixes []string
+	// Port specifies the port of the hostname domain, defaults to the ingress port
+	Port uint32
+	// HostRewrite rewrites the host header of all requests
+	HostRewrite string
+	// ShadowHosts specifies the services which mirror their requests to this one
+	// envoy appends -shadow to the host of mirrored requests
+	ShadowHosts []string
 }
 
 func createEnvoyVHost(cfg VHostConfig) route.VirtualHost {
+	port := cfg.Port
+	if port == 0 {
+		port = defaultIngressTrafficPort
+	}
 	vhost := route.VirtualHost{
 		Name: fmt.Sprintf("vhost_%s", cfg.Hostname),
 		Domains: []string{
 			cfg.Hostname,
-			fmt.Sprintf("%s:%d", cfg.Hostname, defaultIngressTrafficPort),
+			fmt.Sprintf("%s:%d", cfg.Hostname, port),
 		},
-		Routes: []route.Route{
-			{
-				Match: route.RouteMatch{
-					PathSpecifier: &route.RouteMatch_Prefix{
-						Prefix: "/",
-					},
+		Routes: createEnvoyRoutes(cfg),
+	}
+	// envoy versions differ in whether the suffix is placed before the port
+	for _, host := range cfg.ShadowHosts {
+		vhost.Domains = append(vhost.Domains,
+			fmt.Sprintf("%s-shadow", host),
+			fmt.Sprintf("%s-shadow:%d", host, port),
+			fmt.Sprintf("%s:%d-shadow", host, port),
+		)
+	}
+
+	return vhost
+}
+
+func createRouteAction(cfg VHostConfig) *route.RouteAction {
+	timeouts := cfg.Config.Timeout
+	action := &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{
+			Cluster: cfg.Cluster,
+		},
+	}
+	if len(cfg.Split) > 0 {
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+			WeightedClusters: createWeightedClusters(cfg.Cluster, cfg.Split),
+		}
+	}
+	// a zero timeout disables the envoy default timeout
+	action.Timeout = &timeouts.Request
+	if timeouts.Idle > 0 {
+		action.IdleTimeout = &timeouts.Idle
+	}
+	if timeouts.MaxStreamDuration > 0 {
+		action.MaxGrpcTimeout = &timeouts.MaxStreamDuration
+	}
+	if cfg.HostRewrite != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewrite{
+			HostRewrite: cfg.HostRewrite,
+		}
+	}
+	action.HashPolicy = createHashPolicies(cfg.Config.LoadBalancer)
+	if cfg.Config.Protocol == protocolGRPC && cfg.Config.GRPC.RetryOn != "" {
+		action.RetryPolicy = &route.RetryPolicy{
+			RetryOn:    cfg.Config.GRPC.RetryOn,
+			NumRetries: &types.UInt32Value{Value: cfg.Config.GRPC.NumRetries},
+		}
+	}
+	if cfg.Mirror.Service != "" && cfg.Mirror.Percent > 0 {
+		action.RequestMirrorPolicy = &route.RouteAction_RequestMirrorPolicy{
+			Cluster: cfg.Mirror.Service,
+			RuntimeFraction: &core.RuntimeFractionalPercent{
+				DefaultValue: &_type.FractionalPercent{
+					Numerator:   cfg.Mirror.Percent,
+					Denominator: _type.FractionalPercent_HUNDRED,
 				},
-				Action: &route.Route_Route{
-					Route: &route.RouteAction{
-						ClusterSpecifier: &route.RouteAction_Cluster{
-							Cluster: cfg.Cluster,
-						},
-					},
+			},
+		}
+	}
+	return action
+}
+
+func createWeightedClusters(cluster string, split []VersionWeight) *route.WeightedCluster {
+	weighted := &route.WeightedCluster{
+		TotalWeight: &types.UInt32Value{Value: 100},
+	}
+	for _, version := range split {
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   versionClusterName(cluster, version.Version),
+			Weight: &types.UInt32Value{Value: version.Weight},
+		})
+	}
+	return weighted
+}
+
+// createHashPolicies returns the route hash policies
+// for the hash-based load balancing policies
+func createHashPolicies(cfg ClusterLoadBalancerConfig) []*route.RouteAction_HashPolicy {
+	if !cfg.HashBased() {
+		return nil
+	}
+	var policies []*route.RouteAction_HashPolicy
+	if cfg.HashHeader != "" {
+		policies = append(policies, &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{
+					HeaderName: cfg.HashHeader,
 				},
 			},
-		},
+		})
 	}
+	if cfg.HashCookie != "" {
+		// envoy only generates the cookie if the ttl is set
+		// a zero ttl generates a session cookie
+		ttl := cfg.HashCookieTTL
+		cookie := &route.RouteAction_HashPolicy_Cookie{
+			Name: cfg.HashCookie,
+			Ttl:  &ttl,
+		}
+		policies = append(policies, &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+				Cookie: cookie,
+			},
+		})
+	}
+	if cfg.HashSourceIP {
+		policies = append(policies, &route.RouteAction_HashPolicy{
+			PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+				ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{
+					SourceIp: true,
+				},
+			},
+		})
+	}
+	return policies
+}
 
-	return vhost
+// Version returns a hash over all resources of the node.
+// Nodes without EDS endpoints (e.g. the egress gateway)
+// still get a new version when their config changes
+func (n *Node) Version() string {
+	return computeVersion(n.Endpoints(), n.Clusters(), n.Routes(), n.Listeners())
 }
 
-// Endpoints returns the endpoints as cache.Resources
+// Endpoints returns the endpoints as cache.Resources sorted by name
 func (n *Node) Endpoints() (eps []cache.Resource) {
-	for _, ep := range n.endpoints {
-		eps = append(eps, ep)
+	names := make([]string, 0, len(n.endpoints))
+	for name := range n.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		eps = append(eps, n.endpoints[name])
 	}
 	return
 }
 
-// Clusters returns the clusters as cache.Resources
+// Clusters returns the clusters as cache.Resources sorted by name
 func (n *Node) Clusters() (cls []cache.Resource) {
-	for _, c := range n.clusters {
-		cls = append(cls, c)
+	names := make([]string, 0, len(n.clusters))
+	for name := range n.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cls = append(cls, n.clusters[name])
 	}
 	return
 }
 
-// Routes returns the routes as cache.Resources
+// Routes returns the routes as cache.Resources sorted by name
 func (n *Node) Routes() (rs []cache.Resource) {
-	for _, r := range n.routes {
-		rs = append(rs, r)
+	names := make([]string, 0, len(n.routes))
+	for name := range n.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rs = append(rs, n.routes[name])
 	}
 	return
 }
 
-// Listeners returns the listeners as cache.Resources
+// Listeners returns the listeners as cache.Resources sorted by name
 func (n *Node) Listeners() (ls []cache.Resource) {
-	for _, l := range n.listeners {
+	sorted := make([]*v2.Listener, len(n.listeners))
+	copy(sorted, n.listeners)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	for _, l := range sorted {
 		ls = append(ls, l)
 	}
 	return ls
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/route"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestVHostTimeouts(t *testing.T) {
+	cfg := parseClusterAnnotations(map[string]string{
+		AnnotationTimeoutRequest:           "60000",
+		AnnotationTimeoutIdle:              "5000",
+		AnnotationTimeoutMaxStreamDuration: "120000",
+	})
+	vhost := createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   cfg,
+	})
+	assert.Assert(t, is.Len(vhost.Routes, 1))
+	action := vhost.Routes[0].Action.(*route.Route_Route).Route
+	assert.Equal(t, *action.Timeout, time.Minute)
+	assert.Equal(t, *action.IdleTimeout, time.Second*5)
+	assert.Equal(t, *action.MaxGrpcTimeout, time.Minute*2)
+
+	// defaults
+	vhost = createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   parseClusterAnnotations(nil),
+	})
+	action = vhost.Routes[0].Action.(*route.Route_Route).Route
+	assert.Equal(t, *action.Timeout, time.Millisecond*defaultRequestTimeout)
+	assert.Assert(t, action.IdleTimeout == nil)
+	assert.Assert(t, action.MaxGrpcTimeout == nil)
+}
+
+func TestClusterConnectTimeout(t *testing.T) {
+	c := createEnvoyCluster(Cluster{
+		Name: "alpha.svc",
+		Endpoints: []Endpoint{
+			{
+				Address: "1.1.1.1",
+				Port:    1312,
+				Annotations: map[string]string{
+					AnnotationTimeoutConnect: "250",
+				},
+			},
+		},
+	})
+	assert.Equal(t, c.ConnectTimeout, time.Millisecond*250)
+
+	c = createEnvoyCluster(Cluster{Name: "beta.svc"})
+	assert.Equal(t, c.ConnectTimeout, time.Millisecond*defaultConnectTimeout)
+}
+
+func TestClusterOutlierDetection(t *testing.T) {
+	c := createEnvoyCluster(Cluster{Name: "alpha.svc"})
+	assert.Assert(t, c.OutlierDetection != nil)
+	assert.Equal(t, c.OutlierDetection.Consecutive_5Xx.Value, uint32(5))
+	assert.Equal(t, c.OutlierDetection.MaxEjectionPercent.Value, uint32(50))
+	assert.Equal(t, *c.OutlierDetection.BaseEjectionTime, time.Millisecond*defaultOutlierBaseEjectionTime)
+	assert.Assert(t, c.OutlierDetection.ConsecutiveGatewayFailure == nil)
+
+	c = createEnvoyCluster(Cluster{
+		Name: "alpha.svc",
+		Endpoints: []Endpoint{
+			{
+				Address: "1.1.1.1",
+				Port:    1312,
+				Annotations: map[string]string{
+					AnnotationOutlierConsecutiveGatewayErrors: "3",
+					AnnotationOutlierSuccessRateEnforcing:     "0",
+					AnnotationOutlierInterval:                 "2000",
+				},
+			},
+		},
+	})
+	assert.Equal(t, c.OutlierDetection.ConsecutiveGatewayFailure.Value, uint32(3))
+	assert.Equal(t, c.OutlierDetection.EnforcingConsecutiveGatewayFailure.Value, uint32(100))
+	assert.Equal(t, c.OutlierDetection.EnforcingSuccessRate.Value, uint32(0))
+	assert.Equal(t, *c.OutlierDetection.Interval, time.Second*2)
+
+	c = createEnvoyCluster(Cluster{
+		Name: "alpha.svc",
+		Endpoints: []Endpoint{
+			{
+				Address: "1.1.1.1",
+				Port:    1312,
+				Annotations: map[string]string{
+					AnnotationOutlierDisabled: "",
+				},
+			},
+		},
+	})
+	assert.Assert(t, c.OutlierDetection == nil)
+}
+
+func TestLoadBalancerPolicy(t *testing.T) {
+	c := createEnvoyCluster(Cluster{Name: "alpha.svc"})
+	assert.Equal(t, c.LbPolicy, v2.Cluster_ROUND_ROBIN)
+
+	ann := map[string]string{
+		AnnotationLBPolicy:        "ring-hash",
+		AnnotationLBHashHeader:    "x-user-id",
+		AnnotationLBHashCookie:    "session",
+		AnnotationLBHashCookieTTL: "60000",
+	}
+	c = createEnvoyCluster(Cluster{
+		Name: "alpha.svc",
+		Endpoints: []Endpoint{
+			{Address: "1.1.1.1", Port: 1312, Annotations: ann},
+		},
+	})
+	assert.Equal(t, c.LbPolicy, v2.Cluster_RING_HASH)
+
+	vhost := createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   parseClusterAnnotations(ann),
+	})
+	action := vhost.Routes[0].Action.(*route.Route_Route).Route
+	assert.Assert(t, is.Len(action.HashPolicy, 2))
+	assert.Equal(t, action.HashPolicy[0].PolicySpecifier.(*route.RouteAction_HashPolicy_Header_).Header.HeaderName, "x-user-id")
+	cookie := action.HashPolicy[1].PolicySpecifier.(*route.RouteAction_HashPolicy_Cookie_).Cookie
+	assert.Equal(t, cookie.Name, "session")
+	assert.Equal(t, *cookie.Ttl, time.Minute)
+
+	// session cookies are generated, too
+	delete(ann, AnnotationLBHashCookieTTL)
+	vhost = createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   parseClusterAnnotations(ann),
+	})
+	cookie = vhost.Routes[0].GetRoute().HashPolicy[1].GetCookie()
+	assert.Equal(t, *cookie.Ttl, time.Duration(0))
+
+	// hash policies are ignored for non hash-based policies
+	// and invalid policies fall back to round-robin
+	ann[AnnotationLBPolicy] = "sticky"
+	cfg := parseClusterAnnotations(ann)
+	assert.Equal(t, cfg.LoadBalancer.Policy, lbPolicyRoundRobin)
+	assert.Assert(t, is.Len(createHashPolicies(cfg.LoadBalancer), 0))
+}
+
+func TestParseVersionWeights(t *testing.T) {
+	split, err := parseVersionWeights("v1=99, v2=1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, split, []VersionWeight{{Version: "v1", Weight: 99}, {Version: "v2", Weight: 1}})
+
+	_, err = parseVersionWeights("v1=50,v2=20")
+	assert.ErrorContains(t, err, "add up to 70")
+	_, err = parseVersionWeights("v1:100")
+	assert.ErrorContains(t, err, "invalid pair")
+}
+
+func TestClusterHealthChecks(t *testing.T) {
+	// defaults
+	checks := createHealthChecks(parseClusterAnnotations(nil).HealthCheck)
+	assert.Assert(t, is.Len(checks, 1))
+	assert.Equal(t, checks[0].HealthyThreshold.Value, uint32(defaultHealthThreshold))
+	assert.Assert(t, checks[0].IntervalJitter == nil)
+	assert.Equal(t, checks[0].GetHttpHealthCheck().Path, defaultHealthCheckPath)
+
+	cfg := parseClusterAnnotations(map[string]string{
+		AnnotationHealthHost:               "alpha.internal",
+		AnnotationHealthHeaders:            "x-b=2, x-a=1",
+		AnnotationHealthHealthyThreshold:   "1",
+		AnnotationHealthUnhealthyThreshold: "5",
+		AnnotationHealthIntervalJitter:     "500",
+		AnnotationHealthNoTrafficInterval:  "60000",
+	})
+	checks = createHealthChecks(cfg.HealthCheck)
+	assert.Equal(t, checks[0].HealthyThreshold.Value, uint32(1))
+	assert.Equal(t, checks[0].UnhealthyThreshold.Value, uint32(5))
+	assert.Equal(t, *checks[0].IntervalJitter, time.Millisecond*500)
+	assert.Equal(t, *checks[0].NoTrafficInterval, time.Minute)
+	http := checks[0].GetHttpHealthCheck()
+	assert.Equal(t, http.Host, "alpha.internal")
+	assert.Assert(t, is.Len(http.RequestHeadersToAdd, 2))
+	assert.Equal(t, http.RequestHeadersToAdd[0].Header.Key, "x-a")
+
+	cfg = parseClusterAnnotations(map[string]string{
+		AnnotationHealthType:       "tcp",
+		AnnotationHealthTCPSend:    "50494e47",
+		AnnotationHealthTCPReceive: "504f4e47,zz",
+	})
+	tcp := createHealthChecks(cfg.HealthCheck)[0].GetTcpHealthCheck()
+	assert.Equal(t, tcp.Send.GetText(), "50494e47")
+	assert.Assert(t, is.Len(tcp.Receive, 1))
+
+	cfg = parseClusterAnnotations(map[string]string{
+		AnnotationHealthType:        "grpc",
+		AnnotationHealthGRPCService: "alpha.Health",
+	})
+	grpc := createHealthChecks(cfg.HealthCheck)[0].GetGrpcHealthCheck()
+	assert.Equal(t, grpc.ServiceName, "alpha.Health")
+
+	// invalid type falls back to http
+	cfg = parseClusterAnnotations(map[string]string{AnnotationHealthType: "udp"})
+	assert.Equal(t, cfg.HealthCheck.Type, healthCheckHTTP)
+
+	cfg = parseClusterAnnotations(map[string]string{AnnotationHealthDisabled: ""})
+	assert.Assert(t, is.Len(createHealthChecks(cfg.HealthCheck), 0))
+}
+
+func TestClusterPeerHealthChecks(t *testing.T) {
+	annotations := map[string]string{
+		AnnotationHealthHost: "alpha.internal",
+		AnnotationHealthPort: "8081",
+	}
+	// the checks of the peers pass the ingress listener of the sidecar
+	c := createEnvoyCluster(Cluster{Name: "alpha.svc@v2", Annotations: annotations})
+	assert.Assert(t, c.HealthChecks[0].AltPort == nil)
+	assert.Equal(t, c.HealthChecks[0].GetHttpHealthCheck().Host, "alpha.svc")
+
+	c = createEnvoyCluster(Cluster{Name: localClusterName("alpha.svc"), Annotations: annotations})
+	assert.Equal(t, c.HealthChecks[0].AltPort.Value, uint32(8081))
+	assert.Equal(t, c.HealthChecks[0].GetHttpHealthCheck().Host, "alpha.internal")
+
+	c = createEnvoyCluster(Cluster{Name: "db.svc", Annotations: map[string]string{
+		AnnotationProtocol:      "tcp",
+		AnnotationTCPEgressPort: "5432",
+		AnnotationHealthTCPSend: "50494e47",
+	}})
+	assert.Assert(t, c.HealthChecks[0].GetTcpHealthCheck().Send == nil)
+}
+
+func TestClusterProtocol(t *testing.T) {
+	c := createEnvoyCluster(Cluster{Name: "alpha.svc"})
+	assert.Assert(t, c.Http2ProtocolOptions == nil)
+
+	ann := map[string]string{AnnotationProtocol: "grpc"}
+	c = createEnvoyCluster(Cluster{
+		Name: "alpha.svc",
+		Endpoints: []Endpoint{
+			{Address: "1.1.1.1", Port: 1312, Annotations: ann},
+		},
+	})
+	assert.Assert(t, c.Http2ProtocolOptions != nil)
+	assert.Assert(t, c.HealthChecks[0].GetGrpcHealthCheck() != nil)
+
+	// gRPC: retries and no request timeout
+	vhost := createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   parseClusterAnnotations(ann),
+	})
+	action := vhost.Routes[0].Action.(*route.Route_Route).Route
+	assert.Equal(t, *action.Timeout, time.Duration(0))
+	assert.Equal(t, action.RetryPolicy.RetryOn, defaultGRPCRetryOn)
+	assert.Equal(t, action.RetryPolicy.NumRetries.Value, uint32(defaultGRPCRetries))
+
+	ann[AnnotationGRPCRetryOn] = ""
+	vhost = createEnvoyVHost(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Config:   parseClusterAnnotations(ann),
+	})
+	assert.Assert(t, vhost.Routes[0].Action.(*route.Route_Route).Route.RetryPolicy == nil)
+
+	cfg := parseClusterAnnotations(map[string]string{AnnotationProtocol: "http2"})
+	assert.Assert(t, cfg.HTTP2())
+	assert.Equal(t, cfg.HealthCheck.Type, healthCheckHTTP)
+	assert.Equal(t, parseClusterAnnotations(map[string]string{AnnotationProtocol: "http"}).Protocol, protocolHTTP1)
+}
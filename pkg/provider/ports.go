@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultListenerAddress = "0.0.0.0"
+
+// ListenerPortsConfig specifies the addresses and ports of the sidecar listeners
+// empty fields are inherited from the mesh config or the defaults
+type ListenerPortsConfig struct {
+	// EgressAddress defaults to 0.0.0.0, use 127.0.0.1 to accept local apps only
+	EgressAddress string `yaml:"egressAddress"`
+	// EgressPort defaults to 4000
+	EgressPort uint32 `yaml:"egressPort"`
+	// IngressAddress defaults to 0.0.0.0
+	IngressAddress string `yaml:"ingressAddress"`
+	// IngressPort defaults to 4100, the other sidecars connect to it
+	IngressPort uint32 `yaml:"ingressPort"`
+}
+
+// listeners returns the listener ports of a node
+// the node config overrides the mesh config
+func (m MeshConfig) listeners(node NodeConfig) ListenerPortsConfig {
+	cfg := ListenerPortsConfig{
+		EgressAddress:  defaultListenerAddress,
+		EgressPort:     defaultEgressTrafficPort,
+		IngressAddress: defaultListenerAddress,
+		IngressPort:    defaultIngressTrafficPort,
+	}
+	for _, override := range []*ListenerPortsConfig{m.Listeners, node.Listeners} {
+		if override == nil {
+			continue
+		}
+		if err := override.Validate(); err != nil {
+			log.Warnf("invalid listener config: %s", err)
+			continue
+		}
+		cfg = cfg.merge(*override)
+	}
+	if cfg.EgressPort == cfg.IngressPort {
+		log.Warnf("egress and ingress listener use the same port %d, using the defaults", cfg.EgressPort)
+		cfg.EgressPort = defaultEgressTrafficPort
+		cfg.IngressPort = defaultIngressTrafficPort
+	}
+	return cfg
+}
+
+func (c ListenerPortsConfig) merge(override ListenerPortsConfig) ListenerPortsConfig {
+	if override.EgressAddress != "" {
+		c.EgressAddress = override.EgressAddress
+	}
+	if override.EgressPort != 0 {
+		c.EgressPort = override.EgressPort
+	}
+	if override.IngressAddress != "" {
+		c.IngressAddress = override.IngressAddress
+	}
+	if override.IngressPort != 0 {
+		c.IngressPort = override.IngressPort
+	}
+	return c
+}
+
+// Validate returns an error if an address or port is invalid
+func (c ListenerPortsConfig) Validate() error {
+	for _, addr := range []string{c.EgressAddress, c.IngressAddress} {
+		if addr != "" && net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid address: %s", addr)
+		}
+	}
+	for _, port := range []uint32{c.EgressPort, c.IngressPort} {
+		if port > 65535 {
+			return fmt.Errorf("invalid port: %d", port)
+		}
+	}
+	return nil
+}
+
+// ParseListenerPortsConfig parses the listener config from a flat map
+// e.g. egress-address: 127.0.0.1, ingress-port: 4200
+func ParseListenerPortsConfig(in map[string]string) (*ListenerPortsConfig, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	cfg := &ListenerPortsConfig{}
+	for key, val := range in {
+		var err error
+		switch key {
+		case "egress-address":
+			cfg.EgressAddress = val
+		case "egress-port":
+			cfg.EgressPort, err = parseUInt32(val)
+		case "ingress-address":
+			cfg.IngressAddress = val
+		case "ingress-port":
+			cfg.IngressPort, err = parseUInt32(val)
+		default:
+			return nil, fmt.Errorf("unknown field %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %s", key, err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
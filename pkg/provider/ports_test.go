@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseListenerPortsConfig(t *testing.T) {
+	cfg, err := ParseListenerPortsConfig(map[string]string{
+		"egress-address": "127.0.0.1",
+		"ingress-port":   "4200",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *cfg, ListenerPortsConfig{
+		EgressAddress: "127.0.0.1",
+		IngressPort:   4200,
+	})
+
+	cfg, err = ParseListenerPortsConfig(nil)
+	assert.NilError(t, err)
+	assert.Assert(t, cfg == nil)
+
+	_, err = ParseListenerPortsConfig(map[string]string{"egress-address": "localhost"})
+	assert.ErrorContains(t, err, "invalid address")
+	_, err = ParseListenerPortsConfig(map[string]string{"ingress-port": "http"})
+	assert.ErrorContains(t, err, "invalid value of ingress-port")
+	_, err = ParseListenerPortsConfig(map[string]string{"port": "4000"})
+	assert.ErrorContains(t, err, "unknown field")
+
+	// the node overrides the mesh, conflicting ports fall back to the defaults
+	mesh := MeshConfig{Listeners: &ListenerPortsConfig{EgressPort: 5000, IngressPort: 5100}}
+	assert.DeepEqual(t, mesh.listeners(NodeConfig{Listeners: &ListenerPortsConfig{IngressPort: 5200}}), ListenerPortsConfig{
+		EgressAddress:  "0.0.0.0",
+		EgressPort:     5000,
+		IngressAddress: "0.0.0.0",
+		IngressPort:    5200,
+	})
+	assert.Equal(t, mesh.listeners(NodeConfig{Listeners: &ListenerPortsConfig{IngressPort: 5000}}).IngressPort, uint32(defaultIngressTrafficPort))
+}
@@ -18,12 +18,47 @@ const (
 	AnnotationHealthInterval = "healthcheck.interval"
 	// AnnotationHealthCacheDuration specifies the health check cache duration in milliseconds
 	AnnotationHealthCacheDuration = "healthcheck.cache"
+	// AnnotationHealthRespond lets the sidecar answer the health checks of peers
+	// instead of passing them through to the service
+	AnnotationHealthRespond = "healthcheck.respond"
+	// AnnotationHealthMinHealthyPercent specifies the percentage of healthy local endpoints
+	// which is required to respond with a healthy status. defaults to 100
+	AnnotationHealthMinHealthyPercent = "healthcheck.min-healthy-percent"
 	// AnnotationHealthTimeout specifies the timeout of a health-check in milliseconds
 	AnnotationHealthTimeout = "healthcheck.timeout"
 	// AnnotationHealthPort specifies the tcp port for the health-check
 	AnnotationHealthPort = "healthcheck.port"
 	// AnnotationHealthExpectedStatus specifies the accepted status codes
 	AnnotationHealthExpectedStatus = "healthcheck.expected-status"
+	// AnnotationHealthDisabled disables active health checking of the service
+	AnnotationHealthDisabled = "healthcheck.disabled"
+	// AnnotationHealthType specifies the health checker: http, tcp or grpc. defaults to http
+	AnnotationHealthType = "healthcheck.type"
+	// AnnotationHealthHealthyThreshold specifies the number of successful checks
+	// until a host is marked healthy
+	AnnotationHealthHealthyThreshold = "healthcheck.healthy-threshold"
+	// AnnotationHealthUnhealthyThreshold specifies the number of failed checks
+	// until a host is marked unhealthy
+	AnnotationHealthUnhealthyThreshold = "healthcheck.unhealthy-threshold"
+	// AnnotationHealthIntervalJitter specifies a random jitter in milliseconds
+	// which is added to the interval
+	AnnotationHealthIntervalJitter = "healthcheck.interval-jitter"
+	// AnnotationHealthNoTrafficInterval specifies the interval in milliseconds
+	// which is used while the cluster does not receive traffic
+	AnnotationHealthNoTrafficInterval = "healthcheck.no-traffic-interval"
+	// AnnotationHealthHost specifies the host header of HTTP health checks
+	AnnotationHealthHost = "healthcheck.host"
+	// AnnotationHealthHeaders specifies a comma-separated list of name=value headers
+	// which are added to HTTP health checks
+	AnnotationHealthHeaders = "healthcheck.headers"
+	// AnnotationHealthTCPSend specifies the hex encoded payload of TCP health checks
+	// without payload only the connection is checked
+	AnnotationHealthTCPSend = "healthcheck.tcp.send"
+	// AnnotationHealthTCPReceive specifies a comma-separated list of hex encoded payloads
+	// which must be contained in the response
+	AnnotationHealthTCPReceive = "healthcheck.tcp.receive"
+	// AnnotationHealthGRPCService specifies the service name of gRPC health checks
+	AnnotationHealthGRPCService = "healthcheck.grpc.service"
 
 	// AnnotaionCBMaxConn sets the maximum number of connections that Envoy will make to the upstream
 	AnnotaionCBMaxConn = "circuit-breaker.max-connections"
@@ -36,12 +71,113 @@ const (
 	// will allow to the upstream cluster
 	AnnotaionCBMaxRetries = "circuit-breaker.max-retries"
 
+	// AnnotationTimeoutRequest specifies the request timeout of the route in milliseconds
+	AnnotationTimeoutRequest = "timeout.request"
+	// AnnotationTimeoutIdle specifies the stream idle timeout of the route in milliseconds
+	AnnotationTimeoutIdle = "timeout.idle"
+	// AnnotationTimeoutConnect specifies the connect timeout of the cluster in milliseconds
+	AnnotationTimeoutConnect = "timeout.connect"
+	// AnnotationTimeoutMaxStreamDuration specifies the upper bound in milliseconds
+	// of a streaming (grpc-timeout) request
+	AnnotationTimeoutMaxStreamDuration = "timeout.max-stream-duration"
+
+	// AnnotationOutlierDisabled disables outlier detection
+	AnnotationOutlierDisabled = "outlier.disabled"
+	// AnnotationOutlierConsecutive5xx specifies the number of consecutive 5xx responses
+	// before a host is ejected
+	AnnotationOutlierConsecutive5xx = "outlier.consecutive-5xx"
+	// AnnotationOutlierConsecutiveGatewayErrors specifies the number of consecutive
+	// gateway errors (502, 503, 504) before a host is ejected. 0 disables this check
+	AnnotationOutlierConsecutiveGatewayErrors = "outlier.consecutive-gateway-errors"
+	// AnnotationOutlierInterval specifies the ejection analysis interval in milliseconds
+	AnnotationOutlierInterval = "outlier.interval"
+	// AnnotationOutlierBaseEjectionTime specifies the base ejection time in milliseconds
+	AnnotationOutlierBaseEjectionTime = "outlier.base-ejection-time"
+	// AnnotationOutlierMaxEjectionPercent specifies the maximum percentage of hosts
+	// that can be ejected
+	AnnotationOutlierMaxEjectionPercent = "outlier.max-ejection-percent"
+	// AnnotationOutlierSuccessRateEnforcing specifies the percentage chance that a host
+	// is ejected because of its success rate. 0 disables success rate ejection
+	AnnotationOutlierSuccessRateEnforcing = "outlier.success-rate.enforcing"
+	// AnnotationOutlierSuccessRateMinHosts specifies the number of hosts that must
+	// have enough request volume to run the success rate analysis
+	AnnotationOutlierSuccessRateMinHosts = "outlier.success-rate.minimum-hosts"
+	// AnnotationOutlierSuccessRateRequestVolume specifies the minimum number of requests
+	// of a host within an interval to be included in the success rate analysis
+	AnnotationOutlierSuccessRateRequestVolume = "outlier.success-rate.request-volume"
+	// AnnotationOutlierSuccessRateStdevFactor specifies the ejection threshold factor
+	// (divided by 1000) of the success rate standard deviation
+	AnnotationOutlierSuccessRateStdevFactor = "outlier.success-rate.stdev-factor"
+
+	// AnnotationLBPolicy specifies the load balancing policy of the cluster.
+	// oneof: round-robin, least-request, random, ring-hash, maglev
+	AnnotationLBPolicy = "lb.policy"
+	// AnnotationLBHashHeader specifies the request header used to compute
+	// the hash for ring-hash and maglev load balancing
+	AnnotationLBHashHeader = "lb.hash.header"
+	// AnnotationLBHashCookie specifies the cookie used to compute the hash
+	// for ring-hash and maglev load balancing. Envoy generates the cookie if it is missing
+	AnnotationLBHashCookie = "lb.hash.cookie"
+	// AnnotationLBHashCookieTTL specifies the TTL of the generated cookie in milliseconds
+	AnnotationLBHashCookieTTL = "lb.hash.cookie-ttl"
+	// AnnotationLBHashSourceIP uses the source ip to compute the hash
+	AnnotationLBHashSourceIP = "lb.hash.source-ip"
+
+	// AnnotationProtocol specifies the protocol of the service: http1 (or http), http2, grpc or tcp.
+	// defaults to http1. http2 and grpc services are connected with HTTP/2,
+	// tcp services are exposed on dedicated ports using a tcp proxy
+	AnnotationProtocol = "protocol"
+	// AnnotationGRPCRetryOn specifies a comma-separated list of gRPC status codes
+	// which are retried, e.g. "unavailable,cancelled". An empty value disables retries
+	AnnotationGRPCRetryOn = "grpc.retry-on"
+	// AnnotationGRPCNumRetries specifies the number of retries of gRPC requests. defaults to 2
+	AnnotationGRPCNumRetries = "grpc.num-retries"
+	// AnnotationTCPEgressPort specifies the port of the consumer sidecars
+	// which accepts connections to a tcp service. required for tcp services
+	AnnotationTCPEgressPort = "tcp.egress-port"
+	// AnnotationTCPIngressPort specifies the port of the sidecars which expose a tcp service
+	// defaults to the egress port + 100
+	AnnotationTCPIngressPort = "tcp.ingress-port"
+
+	// AnnotationTrafficSplit splits the traffic between versions of a service
+	// the value is a list of version=percent pairs, e.g. "v1=90,v2=10"
+	// the percentages must add up to 100
+	AnnotationTrafficSplit = "traffic.split"
+
+	// AnnotationMirrorService mirrors the requests to the specified service
+	// the responses of the mirror are discarded
+	AnnotationMirrorService = "mirror.service"
+	// AnnotationMirrorPercent specifies the percentage of requests to mirror
+	AnnotationMirrorPercent = "mirror.percent"
+
+	// AnnotationAuthzEnabled enables external authorization on the ingress listener
+	// of the nodes which expose the service. Requires a mesh authz config
+	AnnotationAuthzEnabled = "authz.enabled"
+	// AnnotationAuthzDisabledPaths specifies a comma-separated list of path prefixes
+	// which are not subject to authorization. The health check path is always excluded
+	AnnotationAuthzDisabledPaths = "authz.disabled-paths"
+
+	// AnnotationTracingClientSampling specifies the percentage of requests
+	// which are traced if the client sets the x-client-trace-id header
+	AnnotationTracingClientSampling = "tracing.sampling.client"
+	// AnnotationTracingRandomSampling specifies the percentage of requests
+	// which are randomly traced
+	AnnotationTracingRandomSampling = "tracing.sampling.random"
+	// AnnotationTracingOverallSampling specifies the upper limit of the percentage
+	// of requests which are traced after all other sampling checks
+	AnnotationTracingOverallSampling = "tracing.sampling.overall"
+	// AnnotationTracingTags specifies a comma-separated list of request headers
+	// which are added to the spans as tags
+	AnnotationTracingTags = "tracing.tags"
+
 	// ------
 	// endpoint level annotations
 	// ------
 
 	// AnnotaionEndpointWeight specifies the loadbalancer weight of the endpoint
 	AnnotaionEndpointWeight = "endpoint.weight"
+	// AnnotationEndpointVersion specifies the version of the service the endpoint belongs to
+	AnnotationEndpointVersion = "endpoint.version"
 
 	// ------
 	// listener level annotations
@@ -0,0 +1,431 @@
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/moolen/bent/envoy/api/v2/core"
+	"github.com/moolen/bent/envoy/api/v2/listener"
+	"github.com/moolen/bent/envoy/api/v2/route"
+	rbacfilter "github.com/moolen/bent/envoy/config/filter/http/rbac/v2"
+	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
+	networkrbac "github.com/moolen/bent/envoy/config/filter/network/rbac/v2"
+	rbac "github.com/moolen/bent/envoy/config/rbac/v2"
+	"github.com/moolen/bent/pkg/util"
+)
+
+const (
+	rbacActionAllow = "allow"
+	rbacActionDeny  = "deny"
+
+	defaultRBACHeader = "x-bent-caller"
+)
+
+// RBACConfig defines the service-to-service authorization policies
+type RBACConfig struct {
+	// Shadow only logs policy violations instead of enforcing them
+	Shadow bool `yaml:"shadow"`
+	// Header specifies the identity header, defaults to x-bent-caller
+	// the calling sidecar sets it to the services of its node
+	Header string `yaml:"header"`
+	// Policies are evaluated on the ingress listener of the callee.
+	// A service without allow policies accepts all callers
+	Policies []RBACPolicy `yaml:"policies"`
+}
+
+// RBACPolicy allows or denies requests from a set of callers to a service
+type RBACPolicy struct {
+	Name string `yaml:"name"`
+	// Action is either allow or deny, defaults to allow
+	Action string `yaml:"action"`
+	// From specifies the caller identities, * matches any caller
+	From []string `yaml:"from"`
+	// To specifies the called service
+	To string `yaml:"to"`
+	// Methods restricts the policy to specific HTTP methods
+	Methods []string `yaml:"methods"`
+	// Paths restricts the policy to specific path prefixes
+	Paths []string `yaml:"paths"`
+}
+
+func (c RBACConfig) header() string {
+	if c.Header == "" {
+		return defaultRBACHeader
+	}
+	return c.Header
+}
+
+// identityHeader returns the header which the egress routes of a node
+// must set to identify the caller
+func (c RBACConfig) identityHeader(identity string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{
+			Key:   c.header(),
+			Value: identity,
+		},
+		// overwrite the header to prevent spoofing
+		Append: &types.BoolValue{Value: false},
+	}
+}
+
+// callerIdentity returns the identity of a node: the names of
+// the services it exposes or the node name if it does not expose any
+func callerIdentity(node string, clusters []Cluster) string {
+	var names []string
+	for _, cluster := range clusters {
+		names = append(names, cluster.Name)
+	}
+	if len(names) == 0 {
+		return node
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// InjectRBAC prepends the RBAC filters for the given services to the http filter chain.
+// Deny policies are evaluated before allow policies. The health check paths
+// of the services are always allowed and never denied.
+// order matters!
+func (l Listener) InjectRBAC(cfg RBACConfig, clusters []Cluster) {
+	var filters []*hcm.HttpFilter
+	deny, allow := createRBACRules(cfg, clusters)
+	for _, rules := range []*rbac.RBAC{deny, allow} {
+		if rules == nil {
+			continue
+		}
+		filter := &rbacfilter.RBAC{Rules: rules}
+		if cfg.Shadow {
+			filter = &rbacfilter.RBAC{ShadowRules: rules}
+		}
+		filters = append(filters, &hcm.HttpFilter{
+			Name: util.HTTPRoleBasedAccessControl,
+			ConfigType: &hcm.HttpFilter_TypedConfig{
+				TypedConfig: util.MessageToAny(filter),
+			},
+		})
+	}
+	l.hcm.HttpFilters = append(filters, l.hcm.HttpFilters...)
+}
+
+// createRBACRules returns the deny and allow rules for the given services
+// the rules are nil if there are no policies
+func createRBACRules(cfg RBACConfig, clusters []Cluster) (deny *rbac.RBAC, allow *rbac.RBAC) {
+	restricted := make(map[string]bool)
+	for i, policy := range cfg.Policies {
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("policy-%d", i)
+		}
+		for _, cluster := range clusters {
+			if policy.To != cluster.Name {
+				continue
+			}
+			rules := &allow
+			action := rbac.RBAC_ALLOW
+			if policy.Action == rbacActionDeny {
+				rules = &deny
+				action = rbac.RBAC_DENY
+			} else {
+				restricted[cluster.Name] = true
+			}
+			if *rules == nil {
+				*rules = &rbac.RBAC{
+					Action:   action,
+					Policies: make(map[string]*rbac.Policy),
+				}
+			}
+			(*rules).Policies[policy.Name] = createRBACPolicy(cfg, policy, rbacHealthCheckPath(cluster))
+		}
+	}
+	if allow == nil {
+		return deny, allow
+	}
+
+	// services without allow policies and health checks are unrestricted
+	var unrestricted []*rbac.Permission
+	for _, cluster := range clusters {
+		if !restricted[cluster.Name] {
+			unrestricted = append(unrestricted, createAuthorityPermission(cluster.Name))
+		}
+		path := rbacHealthCheckPath(cluster)
+		if path == "" {
+			continue
+		}
+		unrestricted = append(unrestricted, &rbac.Permission{
+			Rule: &rbac.Permission_AndRules{
+				AndRules: &rbac.Permission_Set{
+					Rules: []*rbac.Permission{
+						createAuthorityPermission(cluster.Name),
+						createHeaderPermission(":path", path, false),
+					},
+				},
+			},
+		})
+	}
+	if len(unrestricted) == 0 {
+		return deny, allow
+	}
+	allow.Policies["bent-unrestricted"] = &rbac.Policy{
+		Permissions: []*rbac.Permission{
+			{
+				Rule: &rbac.Permission_OrRules{
+					OrRules: &rbac.Permission_Set{
+						Rules: unrestricted,
+					},
+				},
+			},
+		},
+		Principals: []*rbac.Principal{
+			{
+				Identifier: &rbac.Principal_Any{Any: true},
+			},
+		},
+	}
+	return deny, allow
+}
+
+// rbacHealthCheckPath returns the path of the health checks which are always allowed
+// it is empty if the service is not health checked
+func rbacHealthCheckPath(cluster Cluster) string {
+	cfg := cluster.Config()
+	if cfg.HealthCheck.Disabled {
+		return ""
+	}
+	return cfg.HealthCheck.requestPath()
+}
+
+// createRBACPolicy returns the policy, deny policies never match the health check path
+func createRBACPolicy(cfg RBACConfig, policy RBACPolicy, healthCheckPath string) *rbac.Policy {
+	rules := []*rbac.Permission{
+		createAuthorityPermission(policy.To),
+	}
+	if policy.Action == rbacActionDeny && healthCheckPath != "" {
+		rules = append(rules, &rbac.Permission{
+			Rule: &rbac.Permission_NotRule{
+				NotRule: createHeaderPermission(":path", healthCheckPath, false),
+			},
+		})
+	}
+	if len(policy.Methods) > 0 {
+		var methods []*rbac.Permission
+		for _, method := range policy.Methods {
+			methods = append(methods, createHeaderPermission(":method", strings.ToUpper(method), false))
+		}
+		rules = append(rules, &rbac.Permission{
+			Rule: &rbac.Permission_OrRules{
+				OrRules: &rbac.Permission_Set{Rules: methods},
+			},
+		})
+	}
+	if len(policy.Paths) > 0 {
+		var paths []*rbac.Permission
+		for _, path := range policy.Paths {
+			paths = append(paths, createHeaderPermission(":path", path, true))
+		}
+		rules = append(rules, &rbac.Permission{
+			Rule: &rbac.Permission_OrRules{
+				OrRules: &rbac.Permission_Set{Rules: paths},
+			},
+		})
+	}
+
+	var principals []*rbac.Principal
+	for _, caller := range policy.From {
+		principals = append(principals, createPrincipal(cfg, caller))
+	}
+
+	return &rbac.Policy{
+		Permissions: []*rbac.Permission{
+			{
+				Rule: &rbac.Permission_AndRules{
+					AndRules: &rbac.Permission_Set{Rules: rules},
+				},
+			},
+		},
+		Principals: principals,
+	}
+}
+
+func createPrincipal(cfg RBACConfig, caller string) *rbac.Principal {
+	if caller == "*" {
+		return &rbac.Principal{
+			Identifier: &rbac.Principal_Any{Any: true},
+		}
+	}
+	// the identity header contains a comma-separated list of services
+	return &rbac.Principal{
+		Identifier: &rbac.Principal_Header{
+			Header: &route.HeaderMatcher{
+				Name: cfg.header(),
+				HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{
+					RegexMatch: fmt.Sprintf("(.*,)?%s(,.*)?", regexp.QuoteMeta(caller)),
+				},
+			},
+		},
+	}
+}
+
+// createNetworkRBACFilters returns the network RBAC filters of a tcp service.
+// tcp connections carry no identity header, the callers are identified
+// by the addresses of the nodes which expose the calling services.
+// Deny policies are evaluated before allow policies
+func createNetworkRBACFilters(cfg RBACConfig, service string, addresses map[string][]string) []listener.Filter {
+	var filters []listener.Filter
+	deny, allow := createNetworkRBACRules(cfg, service, addresses)
+	for _, rules := range []*rbac.RBAC{deny, allow} {
+		if rules == nil {
+			continue
+		}
+		filter := &networkrbac.RBAC{
+			Rules:      rules,
+			StatPrefix: fmt.Sprintf("%s_tcp", tcpIngressListenerName(service)),
+		}
+		if cfg.Shadow {
+			filter.Rules = nil
+			filter.ShadowRules = rules
+		}
+		filters = append(filters, listener.Filter{
+			Name: util.RoleBasedAccessControl,
+			ConfigType: &listener.Filter_TypedConfig{
+				TypedConfig: util.MessageToAny(filter),
+			},
+		})
+	}
+	return filters
+}
+
+// createNetworkRBACRules returns the deny and allow rules of a tcp service
+// methods and paths do not apply to connections: allow policies which
+// specify them are skipped, deny policies deny all connections
+func createNetworkRBACRules(cfg RBACConfig, service string, addresses map[string][]string) (deny *rbac.RBAC, allow *rbac.RBAC) {
+	for i, policy := range cfg.Policies {
+		if policy.To != service {
+			continue
+		}
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("policy-%d", i)
+		}
+		rules := &allow
+		action := rbac.RBAC_ALLOW
+		if policy.Action == rbacActionDeny {
+			rules = &deny
+			action = rbac.RBAC_DENY
+		}
+		if len(policy.Methods) > 0 || len(policy.Paths) > 0 {
+			if action == rbac.RBAC_ALLOW {
+				log.Warnf("rbac policy %s: methods and paths do not apply to tcp service %s, skipping", policy.Name, service)
+				continue
+			}
+			log.Warnf("rbac policy %s: methods and paths do not apply to tcp service %s, denying all connections", policy.Name, service)
+		}
+		// a service with allow policies only accepts the listed callers
+		if *rules == nil {
+			*rules = &rbac.RBAC{
+				Action:   action,
+				Policies: make(map[string]*rbac.Policy),
+			}
+		}
+		var principals []*rbac.Principal
+		for _, caller := range policy.From {
+			principals = append(principals, createSourcePrincipals(caller, service, addresses)...)
+		}
+		if len(principals) == 0 {
+			continue
+		}
+		(*rules).Policies[policy.Name] = &rbac.Policy{
+			Permissions: []*rbac.Permission{
+				{
+					Rule: &rbac.Permission_Any{Any: true},
+				},
+			},
+			Principals: principals,
+		}
+	}
+	return deny, allow
+}
+
+// createSourcePrincipals matches the addresses of the nodes which expose the caller
+func createSourcePrincipals(caller, service string, addresses map[string][]string) []*rbac.Principal {
+	if caller == "*" {
+		return []*rbac.Principal{
+			{
+				Identifier: &rbac.Principal_Any{Any: true},
+			},
+		}
+	}
+	if len(addresses[caller]) == 0 {
+		log.Warnf("rbac: caller %s of tcp service %s has no known address", caller, service)
+	}
+	var principals []*rbac.Principal
+	for _, address := range addresses[caller] {
+		principals = append(principals, &rbac.Principal{
+			Identifier: &rbac.Principal_SourceIp{
+				SourceIp: &core.CidrRange{
+					AddressPrefix: address,
+					PrefixLen:     &types.UInt32Value{Value: 32},
+				},
+			},
+		})
+	}
+	return principals
+}
+
+// serviceAddresses returns the sorted endpoint addresses per service
+func serviceAddresses(providerClusters map[string][]Cluster) map[string][]string {
+	seen := make(map[string]map[string]struct{})
+	for _, clusters := range providerClusters {
+		for _, cluster := range clusters {
+			if seen[cluster.Name] == nil {
+				seen[cluster.Name] = make(map[string]struct{})
+			}
+			for _, ep := range cluster.Endpoints {
+				seen[cluster.Name][ep.Address] = struct{}{}
+			}
+		}
+	}
+	out := make(map[string][]string)
+	for name, addresses := range seen {
+		for address := range addresses {
+			out[name] = append(out[name], address)
+		}
+		sort.Strings(out[name])
+	}
+	return out
+}
+
+// createAuthorityPermission matches the service name with an optional port
+func createAuthorityPermission(service string) *rbac.Permission {
+	return &rbac.Permission{
+		Rule: &rbac.Permission_Header{
+			Header: &route.HeaderMatcher{
+				Name: ":authority",
+				HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{
+					RegexMatch: fmt.Sprintf("%s(:[0-9]+)?", regexp.QuoteMeta(service)),
+				},
+			},
+		},
+	}
+}
+
+func createHeaderPermission(name, value string, prefix bool) *rbac.Permission {
+	header := &route.HeaderMatcher{
+		Name: name,
+		HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+			ExactMatch: value,
+		},
+	}
+	if prefix {
+		header.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{
+			PrefixMatch: value,
+		}
+	}
+	return &rbac.Permission{
+		Rule: &rbac.Permission_Header{
+			Header: header,
+		},
+	}
+}
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/moolen/bent/envoy/api/v2/route"
+	rbac "github.com/moolen/bent/envoy/config/rbac/v2"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCreateRBACRules(t *testing.T) {
+	clusters := []Cluster{
+		{Name: "alpha.svc"},
+		{Name: "beta.svc"},
+	}
+	cfg := RBACConfig{
+		Policies: []RBACPolicy{
+			{Name: "gamma-to-alpha", From: []string{"gamma.svc"}, To: "alpha.svc", Methods: []string{"get"}},
+			{Action: rbacActionDeny, From: []string{"*"}, To: "beta.svc", Paths: []string{"/admin"}},
+			{Name: "unrelated", From: []string{"*"}, To: "delta.svc"},
+		},
+	}
+	deny, allow := createRBACRules(cfg, clusters)
+	assert.Equal(t, deny.Action, rbac.RBAC_DENY)
+	assert.Assert(t, is.Len(deny.Policies, 1))
+	assert.Assert(t, deny.Policies["policy-1"] != nil)
+	// deny policies never match the health check path
+	denyRules := deny.Policies["policy-1"].Permissions[0].Rule.(*rbac.Permission_AndRules).AndRules.Rules
+	assert.Assert(t, is.Len(denyRules, 3))
+	notRule := denyRules[1].Rule.(*rbac.Permission_NotRule).NotRule
+	assert.Equal(t, notRule.Rule.(*rbac.Permission_Header).Header.GetExactMatch(), defaultHealthCheckPath)
+	assert.Equal(t, allow.Action, rbac.RBAC_ALLOW)
+	assert.Assert(t, is.Len(allow.Policies, 2))
+
+	policy := allow.Policies["gamma-to-alpha"]
+	principal := policy.Principals[0].Identifier.(*rbac.Principal_Header).Header
+	assert.Equal(t, principal.Name, defaultRBACHeader)
+	assert.Equal(t, principal.HeaderMatchSpecifier.(*route.HeaderMatcher_RegexMatch).RegexMatch, `(.*,)?gamma\.svc(,.*)?`)
+	rules := policy.Permissions[0].Rule.(*rbac.Permission_AndRules).AndRules.Rules
+	assert.Assert(t, is.Len(rules, 2))
+
+	// beta.svc has no allow policy: it stays reachable
+	// health checks of alpha.svc are always allowed
+	unrestricted := allow.Policies["bent-unrestricted"].Permissions[0].Rule.(*rbac.Permission_OrRules).OrRules.Rules
+	assert.Assert(t, is.Len(unrestricted, 3))
+
+	// gRPC health checks use the path of the health checking protocol, tcp checks have no path
+	clusters = []Cluster{
+		{Name: "alpha.svc", Annotations: map[string]string{AnnotationProtocol: protocolGRPC}},
+		{Name: "beta.svc", Annotations: map[string]string{AnnotationProtocol: protocolTCP}},
+	}
+	assert.Equal(t, rbacHealthCheckPath(clusters[0]), grpcHealthCheckPath)
+	assert.Equal(t, rbacHealthCheckPath(clusters[1]), "")
+	deny, allow = createRBACRules(cfg, clusters)
+	denyRules = deny.Policies["policy-1"].Permissions[0].Rule.(*rbac.Permission_AndRules).AndRules.Rules
+	assert.Assert(t, is.Len(denyRules, 2))
+	unrestricted = allow.Policies["bent-unrestricted"].Permissions[0].Rule.(*rbac.Permission_OrRules).OrRules.Rules
+	assert.Assert(t, is.Len(unrestricted, 2))
+	healthRules := unrestricted[0].Rule.(*rbac.Permission_AndRules).AndRules.Rules
+	assert.Equal(t, healthRules[1].Rule.(*rbac.Permission_Header).Header.GetExactMatch(), grpcHealthCheckPath)
+
+	// no policies for the services: no filters
+	deny, allow = createRBACRules(cfg, []Cluster{{Name: "gamma.svc"}})
+	assert.Assert(t, deny == nil)
+	assert.Assert(t, allow == nil)
+}
+
+func TestRBACIdentity(t *testing.T) {
+	assert.Equal(t, callerIdentity("ingress", nil), "ingress")
+	assert.Equal(t, callerIdentity("node.1", []Cluster{{Name: "beta.svc"}, {Name: "alpha.svc"}}), "alpha.svc,beta.svc")
+
+	header := RBACConfig{}.identityHeader("alpha.svc")
+	assert.Equal(t, header.Header.Key, defaultRBACHeader)
+	assert.Equal(t, header.Append.Value, false)
+}
+
+func TestCreateNetworkRBACRules(t *testing.T) {
+	addresses := serviceAddresses(map[string][]Cluster{
+		"node-1": {{Name: "gamma.svc", Endpoints: []Endpoint{{Address: "10.0.0.2"}, {Address: "10.0.0.1"}}}},
+		"node-2": {{Name: "gamma.svc", Endpoints: []Endpoint{{Address: "10.0.0.1"}}}},
+	})
+	assert.DeepEqual(t, addresses["gamma.svc"], []string{"10.0.0.1", "10.0.0.2"})
+	cfg := RBACConfig{
+		Policies: []RBACPolicy{
+			{Name: "gamma-to-db", From: []string{"gamma.svc"}, To: "db.svc"},
+			{Name: "paths", From: []string{"*"}, To: "db.svc", Paths: []string{"/admin"}},
+			{Name: "unknown", From: []string{"delta.svc"}, To: "db.svc"},
+			{Name: "unrelated", From: []string{"*"}, To: "alpha.svc"},
+		},
+	}
+	deny, allow := createNetworkRBACRules(cfg, "db.svc", addresses)
+	assert.Assert(t, deny == nil)
+	assert.Equal(t, allow.Action, rbac.RBAC_ALLOW)
+	assert.Assert(t, is.Len(allow.Policies, 1))
+	principals := allow.Policies["gamma-to-db"].Principals
+	assert.Assert(t, is.Len(principals, 2))
+	assert.Equal(t, principals[0].Identifier.(*rbac.Principal_SourceIp).SourceIp.AddressPrefix, "10.0.0.1")
+
+	// callers without addresses deny all connections
+	deny, allow = createNetworkRBACRules(RBACConfig{Policies: cfg.Policies[2:3]}, "db.svc", addresses)
+	assert.Assert(t, deny == nil)
+	assert.Assert(t, is.Len(allow.Policies, 0))
+
+	assert.Assert(t, is.Len(createNetworkRBACFilters(cfg, "alpha.svc", addresses), 1))
+	assert.Assert(t, is.Len(createNetworkRBACFilters(cfg, "beta.svc", addresses), 0))
+}
@@ -0,0 +1,393 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/moolen/bent/envoy/api/v2/core"
+	"github.com/moolen/bent/envoy/api/v2/route"
+	authz "github.com/moolen/bent/envoy/config/filter/http/ext_authz/v2"
+	"github.com/moolen/bent/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// RouteRule defines how requests to a service are matched and handled
+// the rules of a service are evaluated in order, the first match wins.
+// Requests that don't match any rule are forwarded to the service
+type RouteRule struct {
+	Match RouteMatch `yaml:"match"`
+	// Version sends the matching requests to a specific version of the service
+	Version string `yaml:"version"`
+	// DisableAuthz skips the external authorization of the matching requests
+	DisableAuthz   bool                 `yaml:"disableAuthz"`
+	Rewrite        RouteRewrite         `yaml:"rewrite"`
+	Redirect       *RouteRedirect       `yaml:"redirect"`
+	DirectResponse *RouteDirectResponse `yaml:"directResponse"`
+}
+
+// RouteMatch specifies the path and header conditions of a rule
+// Prefix and Regex are mutually exclusive, an empty match matches all requests
+type RouteMatch struct {
+	Prefix  string        `yaml:"prefix"`
+	Regex   string        `yaml:"regex"`
+	Headers []HeaderMatch `yaml:"headers"`
+}
+
+// HeaderMatch matches a request header. If no value is specified
+// the header must be present
+type HeaderMatch struct {
+	Name    string `yaml:"name"`
+	Exact   string `yaml:"exact"`
+	Prefix  string `yaml:"prefix"`
+	Regex   string `yaml:"regex"`
+	Present bool   `yaml:"present"`
+}
+
+// RouteRewrite rewrites the request before it is forwarded to the service
+// rewrites are applied once on the ingress side of the called service
+type RouteRewrite struct {
+	Prefix string `yaml:"prefix"`
+	Host   string `yaml:"host"`
+}
+
+// RouteRedirect responds with a redirect
+type RouteRedirect struct {
+	Host  string `yaml:"host"`
+	Path  string `yaml:"path"`
+	HTTPS bool   `yaml:"https"`
+	Code  uint32 `yaml:"code"`
+}
+
+// RouteDirectResponse responds with a fixed status and body
+type RouteDirectResponse struct {
+	Status uint32 `yaml:"status"`
+	Body   string `yaml:"body"`
+}
+
+var redirectCodes = map[uint32]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	303: route.RedirectAction_SEE_OTHER,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// Validate checks the rule for conflicting settings
+func (r RouteRule) Validate() error {
+	if r.Match.Prefix != "" && r.Match.Regex != "" {
+		return fmt.Errorf("prefix and regex match are mutually exclusive")
+	}
+	if r.Redirect != nil && r.DirectResponse != nil {
+		return fmt.Errorf("redirect and direct response are mutually exclusive")
+	}
+	if r.Redirect != nil && r.Redirect.Code != 0 {
+		if _, ok := redirectCodes[r.Redirect.Code]; !ok {
+			return fmt.Errorf("invalid redirect code %d", r.Redirect.Code)
+		}
+	}
+	if r.DirectResponse != nil && (r.DirectResponse.Status < 200 || r.DirectResponse.Status > 599) {
+		return fmt.Errorf("invalid direct response status %d", r.DirectResponse.Status)
+	}
+	for _, header := range r.Match.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("header match without name")
+		}
+	}
+	return nil
+}
+
+// createEnvoyRoutes compiles the rules of a vhost into envoy routes
+// the authz exemptions follow the rules, so they don't shadow them.
+// the default route which forwards all requests to the target cluster is always appended
+func createEnvoyRoutes(cfg VHostConfig) []route.Route {
+	var routes []route.Route
+	for i, rule := range cfg.Rules {
+		if err := rule.Validate(); err != nil {
+			log.Warnf("skipping route rule %d of %s: %s", i, cfg.Hostname, err)
+			continue
+		}
+		routes = append(routes, createEnvoyRoute(cfg, rule))
+	}
+	for _, path := range cfg.AuthzExemptPaths {
+		r := createEnvoyRoute(cfg, RouteRule{DisableAuthz: true})
+		r.Match.PathSpecifier = &route.RouteMatch_Path{
+			Path: path,
+		}
+		routes = append(routes, r)
+	}
+	for _, prefix := range cfg.AuthzExemptPrefixes {
+		routes = append(routes, createEnvoyRoute(cfg, RouteRule{
+			Match:        RouteMatch{Prefix: prefix},
+			DisableAuthz: true,
+		}))
+	}
+	return append(routes, route.Route{
+		Match: route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{
+				Prefix: "/",
+			},
+		},
+		Action: &route.Route_Route{
+			Route: createRouteAction(cfg),
+		},
+	})
+}
+
+func createEnvoyRoute(cfg VHostConfig, rule RouteRule) route.Route {
+	r := route.Route{
+		Match: createRouteMatch(rule.Match),
+	}
+	if rule.DisableAuthz {
+		r.PerFilterConfig = disabledAuthzConfig()
+	}
+	switch {
+	case rule.DirectResponse != nil:
+		r.Action = &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: rule.DirectResponse.Status,
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{
+						InlineString: rule.DirectResponse.Body,
+					},
+				},
+			},
+		}
+	case rule.Redirect != nil:
+		r.Action = &route.Route_Redirect{
+			Redirect: createRedirectAction(*rule.Redirect),
+		}
+	default:
+		if rule.Version != "" && !cfg.Rewrite {
+			cfg.Cluster = versionClusterName(cfg.Cluster, rule.Version)
+			cfg.Split = nil
+		}
+		action := createRouteAction(cfg)
+		if cfg.Rewrite && rule.Rewrite.Prefix != "" {
+			action.PrefixRewrite = rule.Rewrite.Prefix
+		}
+		if cfg.Rewrite && rule.Rewrite.Host != "" {
+			action.HostRewriteSpecifier = &route.RouteAction_HostRewrite{
+				HostRewrite: rule.Rewrite.Host,
+			}
+		}
+		r.Action = &route.Route_Route{
+			Route: action,
+		}
+	}
+	return r
+}
+
+// disabledAuthzConfig returns the per filter config which disables ext_authz on a route
+func disabledAuthzConfig() map[string]*types.Struct {
+	cfg, err := util.MessageToStruct(&authz.ExtAuthzPerRoute{
+		Override: &authz.ExtAuthzPerRoute_Disabled{
+			Disabled: true,
+		},
+	})
+	if err != nil {
+		log.Errorf("error creating authz route config: %s", err)
+		return nil
+	}
+	return map[string]*types.Struct{
+		util.HTTPExternalAuthorization: cfg,
+	}
+}
+
+func createRouteMatch(m RouteMatch) route.RouteMatch {
+	match := route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{
+			Prefix: "/",
+		},
+	}
+	if m.Prefix != "" {
+		match.PathSpecifier = &route.RouteMatch_Prefix{
+			Prefix: m.Prefix,
+		}
+	}
+	if m.Regex != "" {
+		match.PathSpecifier = &route.RouteMatch_Regex{
+			Regex: m.Regex,
+		}
+	}
+	for _, header := range m.Headers {
+		match.Headers = append(match.Headers, createHeaderMatcher(header))
+	}
+	return match
+}
+
+func createHeaderMatcher(h HeaderMatch) *route.HeaderMatcher {
+	matcher := &route.HeaderMatcher{
+		Name: h.Name,
+		HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{
+			PresentMatch: true,
+		},
+	}
+	switch {
+	case h.Exact != "":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{
+			ExactMatch: h.Exact,
+		}
+	case h.Prefix != "":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{
+			PrefixMatch: h.Prefix,
+		}
+	case h.Regex != "":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{
+			RegexMatch: h.Regex,
+		}
+	}
+	return matcher
+}
+
+func createRedirectAction(r RouteRedirect) *route.RedirectAction {
+	redirect := &route.RedirectAction{
+		HostRedirect: r.Host,
+		ResponseCode: redirectCodes[r.Code],
+	}
+	if r.Path != "" {
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{
+			PathRedirect: r.Path,
+		}
+	}
+	if r.HTTPS {
+		redirect.SchemeRewriteSpecifier = &route.RedirectAction_HttpsRedirect{
+			HttpsRedirect: true,
+		}
+	}
+	return redirect
+}
+
+// ParseRouteRules parses route rules from a flat key/value map
+// this is used by providers which can not express structured data, e.g. docker labels.
+// The keys have the form <index>.<field>, e.g.:
+//
+//	0.match.prefix: /api
+//	0.match.headers.x-canary.exact: "true"
+//	0.rewrite.prefix: /
+//	1.direct-response.status: 404
+//
+// The rules are ordered by their index
+func ParseRouteRules(in map[string]string) ([]RouteRule, error) {
+	rules := make(map[int]*RouteRule)
+	headers := make(map[int]map[string]*HeaderMatch)
+	for key, val := range in {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid route key %s", key)
+		}
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("invalid route index in key %s", key)
+		}
+		if rules[idx] == nil {
+			rules[idx] = &RouteRule{}
+			headers[idx] = make(map[string]*HeaderMatch)
+		}
+		if strings.HasPrefix(parts[1], "match.headers.") {
+			err = setHeaderMatch(headers[idx], strings.TrimPrefix(parts[1], "match.headers."), val)
+		} else {
+			err = setRouteField(rules[idx], parts[1], val)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid route key %s: %s", key, err)
+		}
+	}
+
+	var indices []int
+	for idx := range rules {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	var out []RouteRule
+	for _, idx := range indices {
+		var names []string
+		for name := range headers[idx] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rules[idx].Match.Headers = append(rules[idx].Match.Headers, *headers[idx][name])
+		}
+		out = append(out, *rules[idx])
+	}
+	return out, nil
+}
+
+func setHeaderMatch(headers map[string]*HeaderMatch, key, val string) error {
+	pos := strings.LastIndex(key, ".")
+	if pos < 1 {
+		return fmt.Errorf("missing header match type")
+	}
+	name := key[:pos]
+	if headers[name] == nil {
+		headers[name] = &HeaderMatch{Name: name}
+	}
+	switch key[pos+1:] {
+	case "exact":
+		headers[name].Exact = val
+	case "prefix":
+		headers[name].Prefix = val
+	case "regex":
+		headers[name].Regex = val
+	case "present":
+		headers[name].Present = true
+	default:
+		return fmt.Errorf("unknown header match type")
+	}
+	return nil
+}
+
+func setRouteField(rule *RouteRule, field, val string) error {
+	switch field {
+	case "match.prefix":
+		rule.Match.Prefix = val
+	case "match.regex":
+		rule.Match.Regex = val
+	case "disable-authz":
+		rule.DisableAuthz = true
+	case "version":
+		rule.Version = val
+	case "rewrite.prefix":
+		rule.Rewrite.Prefix = val
+	case "rewrite.host":
+		rule.Rewrite.Host = val
+	case "redirect.host", "redirect.path", "redirect.https", "redirect.code":
+		if rule.Redirect == nil {
+			rule.Redirect = &RouteRedirect{}
+		}
+		switch field {
+		case "redirect.host":
+			rule.Redirect.Host = val
+		case "redirect.path":
+			rule.Redirect.Path = val
+		case "redirect.https":
+			rule.Redirect.HTTPS = true
+		case "redirect.code":
+			code, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return err
+			}
+			rule.Redirect.Code = uint32(code)
+		}
+	case "direct-response.status", "direct-response.body":
+		if rule.DirectResponse == nil {
+			rule.DirectResponse = &RouteDirectResponse{}
+		}
+		if field == "direct-response.body" {
+			rule.DirectResponse.Body = val
+			return nil
+		}
+		status, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return err
+		}
+		rule.DirectResponse.Status = uint32(status)
+	default:
+		return fmt.Errorf("unknown field")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/moolen/bent/envoy/api/v2/route"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestParseRouteRules(t *testing.T) {
+	rules, err := ParseRouteRules(map[string]string{
+		"1.direct-response.status":        "404",
+		"1.direct-response.body":          "not found",
+		"0.match.prefix":                  "/api",
+		"0.match.headers.x-canary.exact":  "true",
+		"0.match.headers.x-debug.present": "",
+		"0.rewrite.prefix":                "/",
+		"0.rewrite.host":                  "api.internal",
+		"2.redirect.host":                 "example.com",
+		"2.redirect.https":                "",
+		"2.redirect.code":                 "308",
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(rules, 3))
+	assert.Equal(t, rules[0].Match.Prefix, "/api")
+	assert.DeepEqual(t, rules[0].Match.Headers, []HeaderMatch{
+		{Name: "x-canary", Exact: "true"},
+		{Name: "x-debug", Present: true},
+	})
+	assert.Equal(t, rules[0].Rewrite, RouteRewrite{Prefix: "/", Host: "api.internal"})
+	assert.DeepEqual(t, rules[1].DirectResponse, &RouteDirectResponse{Status: 404, Body: "not found"})
+	assert.DeepEqual(t, rules[2].Redirect, &RouteRedirect{Host: "example.com", HTTPS: true, Code: 308})
+
+	_, err = ParseRouteRules(map[string]string{"a.match.prefix": "/"})
+	assert.ErrorContains(t, err, "invalid route index")
+	_, err = ParseRouteRules(map[string]string{"0.match.foo": "/"})
+	assert.ErrorContains(t, err, "unknown field")
+}
+
+func TestCreateEnvoyRoutes(t *testing.T) {
+	rules := []RouteRule{
+		{
+			Match:   RouteMatch{Prefix: "/api", Headers: []HeaderMatch{{Name: "x-canary", Exact: "true"}}},
+			Rewrite: RouteRewrite{Prefix: "/v2"},
+		},
+		{
+			// invalid: skipped
+			Match: RouteMatch{Prefix: "/foo", Regex: "/bar"},
+		},
+		{
+			Match:          RouteMatch{Regex: "/internal/.*"},
+			DirectResponse: &RouteDirectResponse{Status: 403},
+		},
+	}
+
+	// egress side: no rewrites
+	routes := createEnvoyRoutes(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "alpha.svc",
+		Rules:    rules,
+	})
+	assert.Assert(t, is.Len(routes, 3))
+	assert.Equal(t, routes[0].Match.PathSpecifier.(*route.RouteMatch_Prefix).Prefix, "/api")
+	assert.Equal(t, routes[0].Match.Headers[0].HeaderMatchSpecifier.(*route.HeaderMatcher_ExactMatch).ExactMatch, "true")
+	action := routes[0].Action.(*route.Route_Route).Route
+	assert.Equal(t, action.PrefixRewrite, "")
+	assert.Equal(t, action.ClusterSpecifier.(*route.RouteAction_Cluster).Cluster, "alpha.svc")
+	assert.Equal(t, routes[1].Match.PathSpecifier.(*route.RouteMatch_Regex).Regex, "/internal/.*")
+	assert.Equal(t, routes[1].Action.(*route.Route_DirectResponse).DirectResponse.Status, uint32(403))
+	assert.Equal(t, routes[2].Match.PathSpecifier.(*route.RouteMatch_Prefix).Prefix, "/")
+
+	// ingress side: rewrites are applied
+	routes = createEnvoyRoutes(VHostConfig{
+		Hostname: "alpha.svc",
+		Cluster:  "local_alpha.svc",
+		Rules:    rules,
+		Rewrite:  true,
+	})
+	action = routes[0].Action.(*route.Route_Route).Route
+	assert.Equal(t, action.PrefixRewrite, "/v2")
+	assert.Equal(t, action.ClusterSpecifier.(*route.RouteAction_Cluster).Cluster, "local_alpha.svc")
+}
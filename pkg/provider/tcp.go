@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/core"
+	"github.com/moolen/bent/envoy/api/v2/listener"
+	tcp "github.com/moolen/bent/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/moolen/bent/pkg/util"
+)
+
+// TCPListenerConfig defines the behavior of a tcp proxy listener
+type TCPListenerConfig struct {
+	// Name specifies the name of the listener
+	Name string
+	// Address specifies the IP address the listener listens on
+	Address string
+	// Port specifies the port the listener listens on
+	Port uint32
+	// Cluster specifies the upstream cluster of all connections
+	Cluster string
+	// Config specifies the idle timeout of the connections
+	Config ClusterConfig
+	// AccessLog specifies the access logging of the listener
+	AccessLog AccessLogConfig
+	// Filters specifies the network filters in front of the tcp proxy
+	Filters []listener.Filter
+}
+
+// createTCPProxyListener returns a listener which forwards
+// all connections to the cluster
+func createTCPProxyListener(cfg TCPListenerConfig) *v2.Listener {
+	return &v2.Listener{
+		Name: cfg.Name,
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  cfg.Address,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: cfg.Port,
+					},
+				},
+			},
+		},
+		FilterChains: []listener.FilterChain{{
+			Filters: append(cfg.Filters, createTCPProxyFilter(cfg)),
+		}},
+	}
+}
+
+// createTCPProxyFilter returns a tcp proxy filter which forwards
+// all connections to the cluster
+func createTCPProxyFilter(cfg TCPListenerConfig) listener.Filter {
+	proxy := &tcp.TcpProxy{
+		StatPrefix: fmt.Sprintf("%s_tcp", cfg.Name),
+		ClusterSpecifier: &tcp.TcpProxy_Cluster{
+			Cluster: cfg.Cluster,
+		},
+		AccessLog: createAccessLogs(cfg.AccessLog, cfg.Name),
+	}
+	if cfg.Config.Timeout.Idle > 0 {
+		proxy.IdleTimeout = &cfg.Config.Timeout.Idle
+	}
+	return listener.Filter{
+		Name: util.TCPProxy,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: util.MessageToAny(proxy),
+		},
+	}
+}
+
+// tcpEgressListenerName returns the name of the listener
+// which accepts the connections of the app to a tcp service
+func tcpEgressListenerName(service string) string {
+	return fmt.Sprintf("tcp-egress-%s", service)
+}
+
+// tcpIngressListenerName returns the name of the listener
+// which accepts the connections of the peers to a local tcp service
+func tcpIngressListenerName(service string) string {
+	return fmt.Sprintf("tcp-ingress-%s", service)
+}
@@ -0,0 +1,125 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
+	_type "github.com/moolen/bent/envoy/type"
+)
+
+// TracingConfig defines the sampling and tagging of the spans
+// a nil sampling percentage means that the envoy default is used
+type TracingConfig struct {
+	ClientSampling  *float64 `yaml:"clientSampling"`
+	RandomSampling  *float64 `yaml:"randomSampling"`
+	OverallSampling *float64 `yaml:"overallSampling"`
+	// Verbose adds span annotations with detailed timing information
+	Verbose bool `yaml:"verbose"`
+	// Tags lists the request headers which are added to the spans
+	// of the ingress and egress listeners, the tags are named after the headers
+	Tags []string `yaml:"tags"`
+}
+
+// tracing returns the tracing config of a node:
+// the mesh defaults overridden by the annotations of the services on the node.
+// If multiple services specify a sampling percentage the highest one is used
+func (m MeshConfig) tracing(clusters []Cluster) TracingConfig {
+	var cfg TracingConfig
+	if m.Tracing != nil {
+		cfg = *m.Tracing
+		cfg.Tags = append([]string{}, m.Tracing.Tags...)
+	}
+	var client, random, overall *float64
+	for _, cluster := range clusters {
+		tracing := cluster.Config().Tracing
+		client = maxPercent(client, tracing.ClientSampling)
+		random = maxPercent(random, tracing.RandomSampling)
+		overall = maxPercent(overall, tracing.OverallSampling)
+		cfg.Tags = append(cfg.Tags, tracing.Tags...)
+	}
+	if client != nil {
+		cfg.ClientSampling = client
+	}
+	if random != nil {
+		cfg.RandomSampling = random
+	}
+	if overall != nil {
+		cfg.OverallSampling = overall
+	}
+	return cfg
+}
+
+func maxPercent(a, b *float64) *float64 {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
+
+func createTracing(operation hcm.HttpConnectionManager_Tracing_OperationName, cfg TracingConfig) *hcm.HttpConnectionManager_Tracing {
+	tracing := &hcm.HttpConnectionManager_Tracing{
+		OperationName:   operation,
+		ClientSampling:  createPercent(cfg.ClientSampling),
+		RandomSampling:  createPercent(cfg.RandomSampling),
+		OverallSampling: createPercent(cfg.OverallSampling),
+		Verbose:         cfg.Verbose,
+	}
+	seen := make(map[string]bool)
+	for _, tag := range cfg.Tags {
+		header := strings.ToLower(strings.TrimSpace(tag))
+		if header == "" || seen[header] {
+			continue
+		}
+		seen[header] = true
+		tracing.RequestHeadersForTags = append(tracing.RequestHeadersForTags, header)
+	}
+	return tracing
+}
+
+func createPercent(val *float64) *_type.Percent {
+	if val == nil {
+		return nil
+	}
+	return &_type.Percent{Value: *val}
+}
+
+// getSamplingPercent returns nil if the key is not set or the value is invalid
+func getSamplingPercent(ann map[string]string, key string) *float64 {
+	val, ok := ann[key]
+	if !ok {
+		return nil
+	}
+	num, err := strconv.ParseFloat(val, 64)
+	if err != nil || num < 0 || num > 100 {
+		log.Warnf("invalid sampling percentage %s: %s", key, val)
+		return nil
+	}
+	return &num
+}
+
+// getTracingTags parses a list of request headers
+// invalid headers are ignored
+func getTracingTags(ann map[string]string, key string) []string {
+	var tags []string
+	for _, header := range getStringList(ann, key) {
+		if err := validateTracingTag(header); err != nil {
+			log.Warnf("invalid tracing tag %s: %s", header, err)
+			continue
+		}
+		tags = append(tags, header)
+	}
+	return tags
+}
+
+// validateTracingTag returns an error if the tag is not a request header.
+// The envoy API in use only supports tags with the value of a request header
+func validateTracingTag(header string) error {
+	if strings.ContainsAny(header, "=: ") {
+		return fmt.Errorf("expected a request header, literal and environment tags are not supported")
+	}
+	return nil
+}
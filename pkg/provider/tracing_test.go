@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"testing"
+
+	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestGetTracingTags(t *testing.T) {
+	tags := getTracingTags(map[string]string{
+		AnnotationTracingTags: "team=payments, X-User-Id,pod=env:POD_NAME,x-tenant",
+	}, AnnotationTracingTags)
+	// literal and environment tags are not supported
+	assert.DeepEqual(t, tags, []string{"X-User-Id", "x-tenant"})
+}
+
+func TestMeshTracing(t *testing.T) {
+	ten, fifty := 10.0, 50.0
+	mesh := MeshConfig{
+		Tracing: &TracingConfig{
+			RandomSampling: &ten,
+			ClientSampling: &fifty,
+			Tags:           []string{"x-env", ""},
+		},
+	}
+	clusters := []Cluster{
+		{
+			Name: "alpha.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312, Annotations: map[string]string{
+				AnnotationTracingRandomSampling: "100",
+				AnnotationTracingTags:           "X-User-Id, x-env",
+			}}},
+		},
+		{
+			Name: "beta.svc",
+			Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312, Annotations: map[string]string{
+				AnnotationTracingRandomSampling: "20",
+				// invalid: ignored
+				AnnotationTracingOverallSampling: "120",
+			}}},
+		},
+	}
+	cfg := mesh.tracing(clusters)
+	assert.Equal(t, *cfg.RandomSampling, 100.0)
+	assert.Equal(t, *cfg.ClientSampling, 50.0)
+	assert.Assert(t, cfg.OverallSampling == nil)
+	assert.Assert(t, is.Len(cfg.Tags, 4))
+	// mesh defaults are not modified
+	assert.Assert(t, is.Len(mesh.Tracing.Tags, 2))
+
+	tracing := createTracing(hcm.EGRESS, cfg)
+	assert.Equal(t, tracing.OperationName, hcm.EGRESS)
+	assert.Equal(t, tracing.RandomSampling.Value, 100.0)
+	assert.Assert(t, tracing.OverallSampling == nil)
+	// empty and duplicate headers are ignored
+	assert.DeepEqual(t, tracing.RequestHeadersForTags, []string{"x-env", "x-user-id"})
+
+	// no config: envoy defaults
+	tracing = createTracing(hcm.INGRESS, MeshConfig{}.tracing(nil))
+	assert.Assert(t, tracing.RandomSampling == nil)
+	assert.Assert(t, is.Len(tracing.RequestHeadersForTags, 0))
+}
@@ -0,0 +1,217 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/moolen/bent/envoy/api/v2"
+	"github.com/moolen/bent/envoy/api/v2/core"
+	"github.com/moolen/bent/envoy/api/v2/listener"
+	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/moolen/bent/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTransparentPort  = 15001
+	transparentListenerName = "transparent-outbound"
+	passthroughCluster      = "passthrough"
+	blackholeCluster        = "blackhole"
+)
+
+// TransparentConfig enables the transparent interception of the outbound connections
+// the connections of the apps are redirected to the catch-all listener with iptables
+type TransparentConfig struct {
+	// Port specifies the port of the catch-all listener, defaults to 15001
+	Port uint32 `yaml:"port"`
+	// BlockUnknown closes the connections to destinations outside of the mesh
+	// they are passed through by default
+	BlockUnknown bool `yaml:"blockUnknown"`
+}
+
+func (c TransparentConfig) port() uint32 {
+	if c.Port == 0 {
+		return defaultTransparentPort
+	}
+	return c.Port
+}
+
+// unknownCluster returns the cluster of the connections to destinations outside of the mesh
+func (c TransparentConfig) unknownCluster() string {
+	if c.BlockUnknown {
+		return blackholeCluster
+	}
+	return passthroughCluster
+}
+
+// transparentTarget specifies the original destinations of a service
+// which are the addresses and the port of its endpoints
+type transparentTarget struct {
+	Service   string
+	Port      uint32
+	Addresses []string
+}
+
+func transparentRouteName(service string, port uint32) string {
+	return fmt.Sprintf("transparent_%s_%d", service, port)
+}
+
+// makeTransparentTargets groups the endpoints of the services by port
+// an address and port may only belong to a single service
+func makeTransparentTargets(providerClusters map[string][]Cluster) map[string][]transparentTarget {
+	var nodes []string
+	for node := range providerClusters {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	owners := make(map[string]string)
+	addresses := make(map[string]map[uint32][]string)
+	for _, node := range nodes {
+		for _, cluster := range providerClusters[node] {
+			for _, ep := range cluster.Endpoints {
+				dst := fmt.Sprintf("%s:%d", ep.Address, ep.Port)
+				if owner, ok := owners[dst]; ok {
+					if owner != cluster.Name {
+						log.Warnf("destination %s of %s belongs to %s", dst, cluster.Name, owner)
+					}
+					continue
+				}
+				owners[dst] = cluster.Name
+				if addresses[cluster.Name] == nil {
+					addresses[cluster.Name] = make(map[uint32][]string)
+				}
+				addresses[cluster.Name][ep.Port] = append(addresses[cluster.Name][ep.Port], ep.Address)
+			}
+		}
+	}
+
+	targets := make(map[string][]transparentTarget)
+	for name, ports := range addresses {
+		for port, addrs := range ports {
+			sort.Strings(addrs)
+			targets[name] = append(targets[name], transparentTarget{
+				Service:   name,
+				Port:      port,
+				Addresses: addrs,
+			})
+		}
+		sort.Slice(targets[name], func(i, j int) bool {
+			return targets[name][i].Port < targets[name][j].Port
+		})
+	}
+	return targets
+}
+
+// transparentListenerConfig defines the behavior of the catch-all listener
+type transparentListenerConfig struct {
+	Config TransparentConfig
+	// HTTP contains the targets which are routed by their transparent route
+	HTTP []transparentTarget
+	// TCP contains the targets which are forwarded to their cluster
+	TCP []transparentTarget
+	// GRPC contains the services which use gRPC
+	GRPC map[string]struct{}
+	// Configs specifies the idle timeouts of the tcp services
+	Configs   map[string]ClusterConfig
+	AccessLog AccessLogConfig
+	Tracing   TracingConfig
+}
+
+// createTransparentListener returns the catch-all listener
+// which hands the connections over to a filter chain by their original destination
+func createTransparentListener(cfg transparentListenerConfig) *v2.Listener {
+	lis := &v2.Listener{
+		Name: transparentListenerName,
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  defaultListenerAddress,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: cfg.Config.port(),
+					},
+				},
+			},
+		},
+		UseOriginalDst: &types.BoolValue{Value: true},
+		ListenerFilters: []listener.ListenerFilter{{
+			Name: util.OriginalDestination,
+		}},
+	}
+	for _, target := range cfg.HTTP {
+		routeName := transparentRouteName(target.Service, target.Port)
+		l := NewListener(ListenerConfig{
+			Name:             routeName,
+			TargetRoute:      routeName,
+			TracingOperation: hcm.EGRESS,
+			AccessLog:        cfg.AccessLog,
+			Tracing:          cfg.Tracing,
+		})
+		if _, ok := cfg.GRPC[target.Service]; ok {
+			l.InjectGRPCStats()
+		}
+		lis.FilterChains = append(lis.FilterChains, listener.FilterChain{
+			FilterChainMatch: createOriginalDstMatch(target),
+			Filters:          []listener.Filter{l.connectionManagerFilter()},
+		})
+	}
+	for _, target := range cfg.TCP {
+		lis.FilterChains = append(lis.FilterChains, listener.FilterChain{
+			FilterChainMatch: createOriginalDstMatch(target),
+			Filters: []listener.Filter{createTCPProxyFilter(TCPListenerConfig{
+				Name:      transparentRouteName(target.Service, target.Port),
+				Cluster:   target.Service,
+				Config:    cfg.Configs[target.Service],
+				AccessLog: cfg.AccessLog,
+			})},
+		})
+	}
+	// the other connections are passed through or closed,
+	// envoy rejects a listener without filter chains
+	lis.FilterChains = append(lis.FilterChains, listener.FilterChain{
+		Filters: []listener.Filter{createTCPProxyFilter(TCPListenerConfig{
+			Name:      cfg.Config.unknownCluster(),
+			Cluster:   cfg.Config.unknownCluster(),
+			AccessLog: cfg.AccessLog,
+		})},
+	})
+	return lis
+}
+
+// createOriginalDstMatch matches the connections to the endpoints of the target
+func createOriginalDstMatch(target transparentTarget) *listener.FilterChainMatch {
+	match := &listener.FilterChainMatch{
+		DestinationPort: &types.UInt32Value{Value: target.Port},
+	}
+	for _, addr := range target.Addresses {
+		match.PrefixRanges = append(match.PrefixRanges, &core.CidrRange{
+			AddressPrefix: addr,
+			PrefixLen:     &types.UInt32Value{Value: 32},
+		})
+	}
+	return match
+}
+
+// createPassthroughCluster returns the cluster which connects
+// to the original destination of the connection
+func createPassthroughCluster() *v2.Cluster {
+	return &v2.Cluster{
+		Name:           passthroughCluster,
+		ConnectTimeout: defaultConnectTimeout * time.Millisecond,
+		Type:           v2.Cluster_ORIGINAL_DST,
+		LbPolicy:       v2.Cluster_ORIGINAL_DST_LB,
+	}
+}
+
+// createBlackholeCluster returns the cluster without hosts
+// which closes the connections to destinations outside of the mesh
+func createBlackholeCluster() *v2.Cluster {
+	return &v2.Cluster{
+		Name:           blackholeCluster,
+		ConnectTimeout: defaultConnectTimeout * time.Millisecond,
+		Type:           v2.Cluster_STATIC,
+	}
+}
@@ -3,12 +3,13 @@ package provider
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"fmt"
+	"sort"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/moolen/bent/envoy/api/v2"
 	"github.com/moolen/bent/envoy/api/v2/route"
 	hcm "github.com/moolen/bent/envoy/config/filter/network/http_connection_manager/v2"
 	"github.com/moolen/bent/pkg/cache"
@@ -31,72 +32,510 @@ const (
 type Updater struct {
 	cache    cache.SnapshotCache
 	provider ServiceProvider
+	mesh     MeshConfigProvider
+	nodes    NodeConfigProvider
+	global   GlobalServiceProvider
+	names    NameRegistry
+	status   *annotationStatus
+}
+
+// NameRegistry is notified about the service names of the mesh
+// e.g. the embedded DNS server
+type NameRegistry interface {
+	SetNames(names []string)
 }
 
 // NewUpdater returns a new Updater
+// the provider is used as mesh config provider if it implements MeshConfigProvider
+// and as node config provider if it implements NodeConfigProvider
+// and as global service provider if it implements GlobalServiceProvider
 func NewUpdater(config cache.SnapshotCache, provider ServiceProvider) *Updater {
+	mesh, _ := provider.(MeshConfigProvider)
+	nodes, _ := provider.(NodeConfigProvider)
+	global, _ := provider.(GlobalServiceProvider)
 	return &Updater{
 		cache:    config,
 		provider: provider,
+		mesh:     mesh,
+		nodes:    nodes,
+		global:   global,
+		status:   &annotationStatus{},
+	}
+}
+
+// SetMeshConfigProvider overrides the source of the mesh config
+func (a *Updater) SetMeshConfigProvider(mesh MeshConfigProvider) {
+	a.mesh = mesh
+}
+
+// SetNameRegistry sets the registry which receives the service names
+func (a *Updater) SetNameRegistry(names NameRegistry) {
+	a.names = names
+}
+
+// AnnotationErrors returns the annotation errors of the last update
+func (a Updater) AnnotationErrors() []AnnotationError {
+	return a.status.get()
+}
+
+func (a Updater) getMeshConfig() (MeshConfig, error) {
+	if a.mesh == nil {
+		return MeshConfig{}, nil
+	}
+	return a.mesh.GetMeshConfig()
+}
+
+func (a Updater) getNodeConfig() (map[string]NodeConfig, error) {
+	if a.nodes == nil {
+		return nil, nil
 	}
+	return a.nodes.GetNodeConfig()
+}
+
+func (a Updater) getGlobalServices() ([]Cluster, error) {
+	if a.global == nil {
+		return nil, nil
+	}
+	return a.global.GetGlobalServices()
 }
 
 // transform transforms the clusters from the provider into a []Node
 // the caller is responsible to persist the data
-func transform(providerClusters map[string][]Cluster) ([]*Node, error) {
-	var globalCluster []Cluster
-	var globalVHosts []route.VirtualHost
+// global services are not tied to a node, their endpoints are called directly
+func transform(providerClusters map[string][]Cluster, globalServices []Cluster, nodeConfigs map[string]NodeConfig, mesh MeshConfig) ([]*Node, error) {
 	var nodes []*Node
 
-	// prep global cluster data
+	services := make(map[string]struct{})
 	for _, clusters := range providerClusters {
-		globalCluster = append(globalCluster, makeEgressClusters(clusters)...)
 		for _, cluster := range clusters {
-			globalVHosts = append(globalVHosts, createEnvoyVHost(VHostConfig{
-				Hostname: cluster.Name,
-				Cluster:  cluster.Name,
+			services[cluster.Name] = struct{}{}
+		}
+	}
+	for _, cluster := range globalServices {
+		services[cluster.Name] = struct{}{}
+	}
+
+	// external services may be called like mesh services
+	// but they are not exposed through the ingress gateway
+	external := mesh.externalServices(services)
+	gateway := mesh.egressGateway()
+	if gateway != nil {
+		if _, ok := providerClusters[gateway.node()]; ok {
+			log.Warnf("egress gateway node %s conflicts with a mesh node", gateway.node())
+			gateway = nil
+		}
+	}
+	if gateway != nil {
+		for name := range external {
+			if !gateway.allowed(name) {
+				log.Warnf("external service %s is not allowed by the egress gateway", name)
+				delete(external, name)
+			}
+		}
+	}
+	egressServices := make(map[string]struct{})
+	for name := range services {
+		egressServices[name] = struct{}{}
+	}
+	for name := range external {
+		egressServices[name] = struct{}{}
+	}
+
+	// prep per-service egress data
+	// only the dependencies of a node are added to it
+	serviceClusters := make(map[string][]Cluster)
+	serviceVHosts := make(map[string][]route.VirtualHost)
+	serviceVHostConfigs := make(map[string]VHostConfig)
+	serviceMirrors := make(map[string]string)
+	serviceConfigs := make(map[string]ClusterConfig)
+	tcpServices := make(map[string]ClusterConfig)
+	grpcServices := make(map[string]struct{})
+	// the vhost domains contain the mesh-wide ingress port
+	meshIngressPort := mesh.listeners(NodeConfig{}).IngressPort
+	versions := serviceVersions(providerClusters, globalServices)
+	// addService collects the config and the vhost of a service
+	// the first definition of a service wins
+	addService := func(cluster Cluster) {
+		if _, ok := serviceConfigs[cluster.Name]; ok {
+			return
+		}
+		cfg := cluster.Config()
+		if _, ok := services[cfg.Mirror.Service]; cfg.Mirror.Service != "" && !ok {
+			log.Warnf("mirror service %s of %s does not exist", cfg.Mirror.Service, cluster.Name)
+			cfg.Mirror = ClusterMirrorConfig{}
+		}
+		if cfg.Mirror.Service != "" {
+			serviceMirrors[cluster.Name] = cfg.Mirror.Service
+		}
+		// the weights must add up to 100, the split is dropped
+		// if a version has no endpoints
+		for _, split := range cfg.TrafficSplit {
+			if _, ok := versions[cluster.Name][split.Version]; !ok {
+				log.Warnf("traffic split of %s: version %s does not exist", cluster.Name, split.Version)
+				cfg.TrafficSplit = nil
+				break
+			}
+		}
+		serviceConfigs[cluster.Name] = cfg
+		if cfg.Protocol == protocolGRPC {
+			grpcServices[cluster.Name] = struct{}{}
+		}
+		// tcp services are proxied on dedicated ports
+		if cfg.Protocol == protocolTCP {
+			if cfg.TCP.EgressPort == 0 {
+				log.Warnf("tcp service %s has no egress port", cluster.Name)
+				return
+			}
+			tcpServices[cluster.Name] = cfg
+			return
+		}
+		vhost := VHostConfig{
+			Hostname: cluster.Name,
+			Cluster:  cluster.Name,
+			Config:   cfg,
+			Rules:    cluster.Routes,
+			Split:    cfg.TrafficSplit,
+			Mirror:   cfg.Mirror,
+			Port:     meshIngressPort,
+		}
+		vhost.AuthzExemptPaths, vhost.AuthzExemptPrefixes = mesh.authzExempt(cfg)
+		serviceVHostConfigs[cluster.Name] = vhost
+		serviceVHosts[cluster.Name] = []route.VirtualHost{createEnvoyVHost(vhost)}
+	}
+
+	// mirrorSources returns the sorted services which mirror their requests to the service
+	mirrorSources := func(service string) []string {
+		var sources []string
+		for source, target := range serviceMirrors {
+			if target == service {
+				sources = append(sources, source)
+			}
+		}
+		sort.Strings(sources)
+		return sources
+	}
+
+	// the endpoints of global services are called directly
+	// global services take precedence over the services of the nodes
+	for _, cluster := range globalServices {
+		serviceClusters[cluster.Name] = append(serviceClusters[cluster.Name], cluster)
+		serviceClusters[cluster.Name] = append(serviceClusters[cluster.Name], makeVersionClusters([]Cluster{cluster})...)
+		addService(cluster)
+	}
+	// the nodes are sorted to make the precedence deterministic
+	var nodeNames []string
+	for node := range providerClusters {
+		nodeNames = append(nodeNames, node)
+	}
+	sort.Strings(nodeNames)
+	for _, node := range nodeNames {
+		clusters := providerClusters[node]
+		ingressPort := mesh.listeners(nodeConfigs[node]).IngressPort
+		for _, cluster := range makeEgressClusters(clusters, ingressPort) {
+			serviceClusters[cluster.Name] = append(serviceClusters[cluster.Name], cluster)
+			serviceClusters[cluster.Name] = append(serviceClusters[cluster.Name], makeVersionClusters([]Cluster{cluster})...)
+		}
+		for _, cluster := range clusters {
+			addService(cluster)
+		}
+	}
+
+	externalClusters := make(map[string]*v2.Cluster)
+	for name, svc := range external {
+		if gateway != nil {
+			externalClusters[name] = createEgressGatewayCluster(*gateway, svc)
+			serviceVHostConfigs[name] = createEgressGatewayVHost(svc)
+		} else {
+			externalClusters[name] = createExternalCluster(svc)
+			serviceVHostConfigs[name] = createExternalVHost(svc)
+		}
+		serviceVHosts[name] = []route.VirtualHost{createEnvoyVHost(serviceVHostConfigs[name])}
+	}
+
+	// addClusters adds the clusters of the services to the node
+	// mirrored requests are sent through the node, too.
+	// every service is added once, AddCluster appends the endpoints
+	addClusters := func(node *Node, deps map[string]struct{}) {
+		added := make(map[string]struct{})
+		add := func(name string) {
+			if _, ok := added[name]; ok {
+				return
+			}
+			added[name] = struct{}{}
+			node.AddCluster(serviceClusters[name]...)
+			if c, ok := externalClusters[name]; ok {
+				node.AddEnvoyCluster(c)
+			}
+		}
+		for name := range deps {
+			if mirror, ok := serviceMirrors[name]; ok {
+				add(mirror)
+			}
+			add(name)
+		}
+	}
+
+	// addEgress adds the clusters and vhosts of the services to the node
+	addEgress := func(node *Node, routeName string, deps map[string]struct{}) {
+		addClusters(node, deps)
+		var names []string
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			node.AddRoute(routeName, serviceVHosts[name]...)
+		}
+	}
+
+	// addTCPEgress adds a tcp proxy listener per tcp service to the node
+	// ports holds the ports which are already in use on the node
+	addTCPEgress := func(node *Node, deps map[string]struct{}, ports map[uint32]string, address string, accessLog AccessLogConfig) {
+		var names []string
+		for name := range deps {
+			if _, ok := tcpServices[name]; ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cfg := tcpServices[name]
+			if other, ok := ports[cfg.TCP.EgressPort]; ok {
+				log.Warnf("node %s: egress port of tcp service %s is used by %s", node.Name, name, other)
+				continue
+			}
+			ports[cfg.TCP.EgressPort] = name
+			node.AddListener(createTCPProxyListener(TCPListenerConfig{
+				Name:      tcpEgressListenerName(name),
+				Address:   address,
+				Port:      cfg.TCP.EgressPort,
+				Cluster:   name,
+				Config:    cfg,
+				AccessLog: accessLog,
 			}))
 		}
 	}
 
+	// addBindings adds a dedicated listener per bound dependency
+	// it returns the routes of the http listeners
+	addBindings := func(node *Node, deps map[string]struct{}, ports map[uint32]string, bindings []ServiceBinding, accessLog AccessLogConfig, tracing TracingConfig) []string {
+		var routes []string
+		for _, binding := range bindings {
+			if err := binding.Validate(); err != nil {
+				log.Warnf("node %s: invalid binding: %s", node.Name, err)
+				continue
+			}
+			if _, ok := deps[binding.Service]; !ok {
+				log.Warnf("node %s: bound service %s is not a dependency", node.Name, binding.Service)
+				continue
+			}
+			if other, ok := ports[binding.Port]; ok {
+				log.Warnf("node %s: binding of %s uses the port of %s", node.Name, binding.Service, other)
+				continue
+			}
+			ports[binding.Port] = binding.Service
+			if cfg, ok := tcpServices[binding.Service]; ok {
+				node.AddListener(createTCPProxyListener(TCPListenerConfig{
+					Name:      bindingListenerName(binding),
+					Address:   binding.address(),
+					Port:      binding.Port,
+					Cluster:   binding.Service,
+					Config:    cfg,
+					AccessLog: accessLog,
+				}))
+				continue
+			}
+			vhost, ok := serviceVHostConfigs[binding.Service]
+			if !ok {
+				continue
+			}
+			routeName := bindingRouteName(binding)
+			node.AddRoute(routeName, createBindingVHost(vhost))
+			lis := NewListener(ListenerConfig{
+				Address:          binding.address(),
+				Port:             binding.Port,
+				Name:             bindingListenerName(binding),
+				TargetRoute:      routeName,
+				TracingOperation: hcm.EGRESS,
+				AccessLog:        accessLog,
+				Tracing:          tracing,
+			})
+			if _, ok := grpcServices[binding.Service]; ok {
+				lis.InjectGRPCStats()
+			}
+			node.AddListener(lis.Resource())
+			routes = append(routes, routeName)
+		}
+		return routes
+	}
+
+	// addTransparent adds the catch-all listener of the intercepted connections
+	// it returns the routes of the http services
+	transparentTargets := makeTransparentTargets(providerClusters)
+	addTransparent := func(node *Node, deps map[string]struct{}, accessLog AccessLogConfig, tracing TracingConfig) []string {
+		cfg := transparentListenerConfig{
+			Config:    *mesh.Transparent,
+			GRPC:      grpcServices,
+			Configs:   tcpServices,
+			AccessLog: accessLog,
+			Tracing:   tracing,
+		}
+		var names []string
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var routes []string
+		for _, name := range names {
+			for _, target := range transparentTargets[name] {
+				if _, ok := tcpServices[name]; ok {
+					cfg.TCP = append(cfg.TCP, target)
+					continue
+				}
+				vhost, ok := serviceVHostConfigs[name]
+				if !ok {
+					continue
+				}
+				routeName := transparentRouteName(name, target.Port)
+				node.AddRoute(routeName, createBindingVHost(vhost))
+				routes = append(routes, routeName)
+				cfg.HTTP = append(cfg.HTTP, target)
+			}
+		}
+		node.AddListener(createTransparentListener(cfg))
+		if cfg.Config.BlockUnknown {
+			node.AddEnvoyCluster(createBlackholeCluster())
+		} else {
+			node.AddEnvoyCluster(createPassthroughCluster())
+		}
+		return routes
+	}
+
+	var addresses map[string][]string
+	if mesh.RBAC != nil {
+		addresses = serviceAddresses(providerClusters)
+	}
+
 	for node, clusters := range providerClusters {
 		node := NewNode(node)
+		accessLog := mesh.accessLog(nodeConfigs[node.Name])
+		listeners := mesh.listeners(nodeConfigs[node.Name])
 
-		// global
-		node.AddCluster(globalCluster...)
-		node.AddRoute(egressRoute, globalVHosts...)
+		// envoy rejects all listeners of an update if two of them share a port
+		ports := map[uint32]string{
+			listeners.EgressPort:  "the egress listener",
+			listeners.IngressPort: "the ingress listener",
+		}
+		if mesh.Transparent != nil {
+			ports[mesh.Transparent.port()] = "the transparent listener"
+		}
+		tcpIngress := make(map[string]struct{})
+		for _, cluster := range clusters {
+			cfg := cluster.Config()
+			if cfg.Protocol != protocolTCP || cfg.TCP.IngressPort == 0 {
+				continue
+			}
+			if other, ok := ports[cfg.TCP.IngressPort]; ok {
+				log.Warnf("node %s: ingress port of tcp service %s is used by %s", node.Name, cluster.Name, other)
+				continue
+			}
+			ports[cfg.TCP.IngressPort] = cluster.Name
+			tcpIngress[cluster.Name] = struct{}{}
+		}
+
+		// egress
+		deps := mesh.dependencies(nodeConfigs[node.Name], egressServices)
+		node.AddRoute(egressRoute)
+		addEgress(node, egressRoute, deps)
+		addTCPEgress(node, deps, ports, listeners.EgressAddress, accessLog)
+		tracing := mesh.tracing(clusters)
+		egressRoutes := append([]string{egressRoute}, addBindings(node, deps, ports, nodeConfigs[node.Name].Bindings, accessLog, tracing)...)
+		if mesh.Transparent != nil {
+			egressRoutes = append(egressRoutes, addTransparent(node, deps, accessLog, tracing)...)
+		}
+		if mesh.RBAC != nil {
+			for _, routeName := range egressRoutes {
+				node.AddRouteHeaders(routeName, mesh.RBAC.identityHeader(callerIdentity(node.Name, clusters)))
+			}
+		}
 
 		ingressListener := NewListener(ListenerConfig{
-			Address:          "0.0.0.0",
-			Port:             defaultIngressTrafficPort,
+			Address:          listeners.IngressAddress,
+			Port:             listeners.IngressPort,
 			Name:             "default-ingress",
 			TargetRoute:      ingressRoute,
 			TracingOperation: hcm.INGRESS,
+			AccessLog:        accessLog,
+			Tracing:          tracing,
 		})
 		egressListener := NewListener(ListenerConfig{
-			Address:          "0.0.0.0",
-			Port:             defaultEgressTrafficPort,
+			Address:          listeners.EgressAddress,
+			Port:             listeners.EgressPort,
 			Name:             "default-egress",
 			TargetRoute:      egressRoute,
 			TracingOperation: hcm.EGRESS,
+			AccessLog:        accessLog,
+			Tracing:          tracing,
 		})
 
 		// internal cluster & endpoints
 		for _, cluster := range clusters {
-			// local clusters have a prefix like this: local_beta.svc
-			localClusterName := fmt.Sprintf("%s_%s", localClusterPrefix, cluster.Name)
+			localCluster := localClusterName(cluster.Name)
 
 			node.AddCluster(Cluster{
-				Name:      localClusterName,
-				Endpoints: cluster.Endpoints,
+				Name:        localCluster,
+				Annotations: cluster.Annotations,
+				Endpoints:   cluster.Endpoints,
 			})
-			node.AddRoute(ingressRoute, createEnvoyVHost(VHostConfig{
-				Hostname: cluster.Name,
-				Cluster:  localClusterName,
-			}))
+			cfg := cluster.Config()
+			if cfg.Protocol == protocolTCP {
+				if cfg.TCP.IngressPort == 0 {
+					log.Warnf("tcp service %s has no ingress port", cluster.Name)
+					continue
+				}
+				if _, ok := tcpIngress[cluster.Name]; !ok {
+					continue
+				}
+				tcpCfg := TCPListenerConfig{
+					Name:      tcpIngressListenerName(cluster.Name),
+					Address:   listeners.IngressAddress,
+					Port:      cfg.TCP.IngressPort,
+					Cluster:   localCluster,
+					Config:    cfg,
+					AccessLog: accessLog,
+				}
+				if mesh.RBAC != nil {
+					tcpCfg.Filters = createNetworkRBACFilters(*mesh.RBAC, cluster.Name, addresses)
+				}
+				node.AddListener(createTCPProxyListener(tcpCfg))
+				continue
+			}
+			vhost := VHostConfig{
+				Hostname:    cluster.Name,
+				Cluster:     localCluster,
+				Config:      cfg,
+				Rules:       cluster.Routes,
+				Rewrite:     true,
+				ShadowHosts: mirrorSources(cluster.Name),
+			}
+			vhost.AuthzExemptPaths, vhost.AuthzExemptPrefixes = mesh.authzExempt(cfg)
+			node.AddRoute(ingressRoute, createEnvoyVHost(vhost))
+
+			ingressListener.InjectFault(cfg.FaultConfig)
+		}
+		ingressListener.InjectHealthCheck(clusters)
 
-			ingressListener.InjectHealthCheckCache(cluster)
-			ingressListener.InjectFault(cluster.Config().FaultConfig)
+		if hasGRPCService(grpcServices, deps) {
+			egressListener.InjectGRPCStats()
+		}
+		if hasGRPCService(grpcServices, clusterNames(clusters)) {
+			ingressListener.InjectGRPCStats()
+		}
+		if mesh.RBAC != nil {
+			ingressListener.InjectRBAC(*mesh.RBAC, clusters)
+		}
+		if mesh.authzEnabled(node.Name, clusters) {
+			ingressListener.InjectAuthz(*mesh.Authz)
 		}
 
 		node.AddListener(ingressListener.Resource(), egressListener.Resource())
@@ -104,41 +543,190 @@ func transform(providerClusters map[string][]Cluster) ([]*Node, error) {
 	}
 
 	// handle ingress
-	node := NewNode("ingress")
-	node.AddCluster(globalCluster...)
-	node.AddRoute(ingressRoute, globalVHosts...)
-	ingressListener := NewListener(ListenerConfig{
-		Address:          "0.0.0.0",
-		Port:             defaultIngressTrafficPort,
-		TargetRoute:      ingressRoute,
-		TracingOperation: hcm.INGRESS,
-	})
-	ingressListener.InjectAuthz(AuthzConfig{
-		Cluster: "authz",
-	})
-	node.AddListener(ingressListener.Resource())
-	nodes = append(nodes, node)
+	// the default ingress gateway may call all services
+	// declared gateways only expose the services of their routes
+	newIngressListener := func(node *Node, cfg ListenerConfig, exposed map[string]struct{}) *Listener {
+		tracing := mesh.tracing(nil)
+		cfg.TargetRoute = ingressRoute
+		cfg.TracingOperation = hcm.INGRESS
+		cfg.AccessLog = mesh.accessLog(nodeConfigs[node.Name])
+		cfg.Tracing = tracing
+		lis := NewListener(cfg)
+		if hasGRPCService(grpcServices, exposed) {
+			lis.InjectGRPCStats()
+		}
+		if mesh.authzEnabled(node.Name, nil) {
+			lis.InjectAuthz(*mesh.Authz)
+		}
+		return lis
+	}
+	addIngressHeaders := func(node *Node) {
+		if mesh.RBAC != nil {
+			node.AddRouteHeaders(ingressRoute, mesh.RBAC.identityHeader(node.Name))
+		}
+	}
+	if len(mesh.IngressGateways) == 0 {
+		node := NewNode("ingress")
+		node.AddRoute(ingressRoute)
+		addEgress(node, ingressRoute, services)
+		addIngressHeaders(node)
+		listeners := mesh.listeners(nodeConfigs[node.Name])
+		node.AddListener(newIngressListener(node, ListenerConfig{
+			Address: listeners.IngressAddress,
+			Port:    listeners.IngressPort,
+		}, services).Resource())
+		nodes = append(nodes, node)
+	}
+	for _, gw := range mesh.IngressGateways {
+		if err := gw.Validate(); err != nil {
+			log.Warnf("skipping ingress gateway: %s", err)
+			continue
+		}
+		if _, ok := providerClusters[gw.Node]; ok {
+			log.Warnf("ingress gateway node %s conflicts with a mesh node", gw.Node)
+			continue
+		}
+		node := NewNode(gw.Node)
+		exposed := gw.exposedServices(serviceConfigs)
+		node.AddRoute(ingressRoute, createIngressGatewayVHosts(gw, serviceConfigs)...)
+		addClusters(node, exposed)
+		addIngressHeaders(node)
+		if gw.plaintext() {
+			node.AddListener(newIngressListener(node, ListenerConfig{
+				Name:    "ingress-gateway",
+				Address: defaultListenerAddress,
+				Port:    gw.port(),
+			}, exposed).Resource())
+		}
+		if len(gw.Certificates) > 0 {
+			node.AddListener(newIngressListener(node, ListenerConfig{
+				Name:    "ingress-gateway-tls",
+				Address: defaultListenerAddress,
+				Port:    gw.tlsPort(),
+				TLS:     gw.Certificates,
+			}, exposed).Resource())
+		}
+		nodes = append(nodes, node)
+	}
+
+	// handle egress gateway
+	// it holds the clusters of the allowed external services
+	if gateway != nil {
+		node := NewNode(gateway.node())
+		node.AddRoute(ingressRoute)
+		var names []string
+		for name := range external {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			node.AddEnvoyCluster(createExternalCluster(external[name]))
+			node.AddRoute(ingressRoute, createEnvoyVHost(createExternalVHost(external[name])))
+		}
+		tracing := mesh.tracing(nil)
+		lis := NewListener(ListenerConfig{
+			Address:          defaultListenerAddress,
+			Port:             gateway.port(),
+			Name:             "egress-gateway",
+			TargetRoute:      ingressRoute,
+			TracingOperation: hcm.EGRESS,
+			AccessLog:        mesh.accessLog(nodeConfigs[node.Name]),
+			Tracing:          tracing,
+		})
+		// the policies of the external services are enforced by the gateway
+		clusters := egressGatewayClusters(external)
+		if mesh.RBAC != nil {
+			lis.InjectRBAC(*mesh.RBAC, clusters)
+		}
+		if mesh.authzEnabled(node.Name, clusters) {
+			lis.InjectAuthz(*mesh.Authz)
+		}
+		node.AddListener(lis.Resource())
+		nodes = append(nodes, node)
+	}
 	return nodes, nil
 }
 
+// serviceNames returns the sorted names of the mesh, global and external services
+func serviceNames(providerClusters map[string][]Cluster, globalServices []Cluster, mesh MeshConfig) []string {
+	services := make(map[string]struct{})
+	for _, clusters := range providerClusters {
+		for _, cluster := range clusters {
+			services[cluster.Name] = struct{}{}
+		}
+	}
+	for _, cluster := range globalServices {
+		services[cluster.Name] = struct{}{}
+	}
+	var names []string
+	for name := range services {
+		names = append(names, name)
+	}
+	for name := range mesh.externalServices(services) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasGRPCService returns true if one of the services is a gRPC service
+func hasGRPCService(grpcServices map[string]struct{}, services map[string]struct{}) bool {
+	for name := range services {
+		if _, ok := grpcServices[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func clusterNames(clusters []Cluster) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, cluster := range clusters {
+		names[cluster.Name] = struct{}{}
+	}
+	return names
+}
+
 // Run continuously polls the provider for changes and updates the cache accordingly
 // every node has its own configuration
 func (a Updater) Run() {
 	for {
 		var nodes []*Node
 		var snap cache.Snapshot
+		var meshConfig MeshConfig
+		var nodeConfig map[string]NodeConfig
+		var globalServices []Cluster
 		providerEndpoints, err := a.provider.GetClusters()
 		if err != nil {
 			log.Errorf("error fetching globalCluster: %s", err)
 			goto Wait
 		}
-		nodes, err = transform(providerEndpoints)
+		meshConfig, err = a.getMeshConfig()
+		if err != nil {
+			log.Errorf("error fetching mesh config: %s", err)
+			goto Wait
+		}
+		nodeConfig, err = a.getNodeConfig()
+		if err != nil {
+			log.Errorf("error fetching node config: %s", err)
+			goto Wait
+		}
+		globalServices, err = a.getGlobalServices()
+		if err != nil {
+			log.Errorf("error fetching global services: %s", err)
+			goto Wait
+		}
+		a.status.set(validateClusters(providerEndpoints, globalServices))
+		nodes, err = transform(providerEndpoints, globalServices, nodeConfig, meshConfig)
 		if err != nil {
 			log.Errorf("error transforming data: %s", err)
 		}
+		if a.names != nil {
+			a.names.SetNames(serviceNames(providerEndpoints, globalServices, meshConfig))
+		}
 		for _, node := range nodes {
 			snap = cache.NewSnapshot(
-				computeVersion(node.Endpoints()),
+				node.Version(),
 				node.Endpoints(),
 				node.Clusters(),
 				node.Routes(),
@@ -154,14 +742,16 @@ func (a Updater) Run() {
 
 // computeVersion takes a bunch of resources
 // and computes a hash using their protobuf representation
-func computeVersion(resources []cache.Resource) string {
+func computeVersion(resources ...[]cache.Resource) string {
 	hash := md5.New()
-	for _, ep := range resources {
-		b, err := proto.Marshal(ep)
-		if err != nil {
-			continue
+	for _, list := range resources {
+		for _, res := range list {
+			b, err := proto.Marshal(res)
+			if err != nil {
+				continue
+			}
+			hash.Write(b)
 		}
-		hash.Write(b)
 	}
 	return hex.EncodeToString(hash.Sum(nil))
 }
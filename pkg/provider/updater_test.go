@@ -2,10 +2,18 @@ package provider
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/moolen/bent/envoy/api/v2"
 	"github.com/moolen/bent/envoy/api/v2/core"
 	"github.com/moolen/bent/envoy/api/v2/endpoint"
+	"github.com/moolen/bent/envoy/api/v2/route"
+	"github.com/moolen/bent/pkg/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
 )
 
 type TestProvider struct {
@@ -198,7 +206,7 @@ func TestTransform(t *testing.T) {
 		},
 	}
 
-	nodes, err := transform(test)
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
 	if err != nil {
 		t.Error(err)
 	}
@@ -294,3 +302,997 @@ func getAddress(ep endpoint.LbEndpoint) string {
 func getPort(ep endpoint.LbEndpoint) uint32 {
 	return ep.HostIdentifier.(*endpoint.LbEndpoint_Endpoint).Endpoint.Address.Address.(*core.Address_SocketAddress).SocketAddress.PortSpecifier.(*core.SocketAddress_PortValue).PortValue
 }
+
+func TestTransformTrafficSplit(t *testing.T) {
+	split := "v1=90,v2=10"
+	test := map[string][]Cluster{
+		"beta.1": {
+			{
+				Name: "beta.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationEndpointVersion: "v1",
+							AnnotationTrafficSplit:    split,
+						},
+					},
+				},
+			},
+		},
+		"beta.2": {
+			{
+				Name: "beta.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.2",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationEndpointVersion: "v2",
+							AnnotationTrafficSplit:    split,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if err := checkCluster(node, "beta.svc@v1", []Endpoint{{Address: "1.1.1.1", Port: defaultIngressTrafficPort}}); err != nil {
+			t.Errorf("node %s: %s", node.Name, err)
+		}
+		if err := checkCluster(node, "beta.svc@v2", []Endpoint{{Address: "1.1.1.2", Port: defaultIngressTrafficPort}}); err != nil {
+			t.Errorf("node %s: %s", node.Name, err)
+		}
+		if err := checkCluster(node, "beta.svc", []Endpoint{
+			{Address: "1.1.1.1", Port: defaultIngressTrafficPort},
+			{Address: "1.1.1.2", Port: defaultIngressTrafficPort},
+		}); err != nil {
+			t.Errorf("node %s: %s", node.Name, err)
+		}
+
+		routeName := egressRoute
+		if node.Name == "ingress" {
+			routeName = ingressRoute
+		}
+		vhosts := node.routes[routeName].VirtualHosts
+		if len(vhosts) != 1 {
+			t.Fatalf("node %s: expected one vhost, found %d", node.Name, len(vhosts))
+		}
+		action := vhosts[0].Routes[0].Action.(*route.Route_Route).Route
+		weighted, ok := action.ClusterSpecifier.(*route.RouteAction_WeightedClusters)
+		if !ok {
+			t.Fatalf("node %s: expected weighted clusters, found %#v", node.Name, action.ClusterSpecifier)
+		}
+		clusters := weighted.WeightedClusters.Clusters
+		if len(clusters) != 2 || clusters[0].Name != "beta.svc@v1" || clusters[0].Weight.Value != 90 ||
+			clusters[1].Name != "beta.svc@v2" || clusters[1].Weight.Value != 10 {
+			t.Errorf("node %s: unexpected weighted clusters: %#v", node.Name, clusters)
+		}
+	}
+}
+
+func TestTransformTrafficSplitUnknownVersion(t *testing.T) {
+	test := map[string][]Cluster{
+		"beta.1": {
+			{
+				Name: "beta.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationEndpointVersion: "v1",
+							AnnotationTrafficSplit:    "v1=90,v3=10",
+						},
+					},
+				},
+			},
+		},
+	}
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Name != "ingress" {
+			continue
+		}
+		// the split is dropped, all versions receive traffic
+		action := node.routes[ingressRoute].VirtualHosts[0].Routes[0].GetRoute()
+		assert.Equal(t, action.GetCluster(), "beta.svc")
+	}
+}
+
+func TestTransformMirror(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name: "alpha.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationMirrorService: "alpha-next.svc",
+							AnnotationMirrorPercent: "10",
+						},
+					},
+				},
+			},
+		},
+		"alpha-next.1": {
+			{
+				Name: "alpha-next.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.2",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationMirrorService: "missing.svc",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		routeName := egressRoute
+		if node.Name == "ingress" {
+			routeName = ingressRoute
+		}
+		if _, ok := node.clusters["alpha-next.svc"]; !ok {
+			t.Errorf("node %s: missing mirror cluster", node.Name)
+		}
+		// the mirror is a dependency, too: its endpoints are added once
+		if n := len(node.endpoints["alpha-next.svc"].Endpoints[0].LbEndpoints); n != 1 {
+			t.Errorf("node %s: expected 1 mirror endpoint, found %d", node.Name, n)
+		}
+		for _, vhost := range node.routes[routeName].VirtualHosts {
+			policy := vhost.Routes[0].Action.(*route.Route_Route).Route.RequestMirrorPolicy
+			switch vhost.Name {
+			case "vhost_alpha.svc":
+				if policy == nil || policy.Cluster != "alpha-next.svc" || policy.RuntimeFraction.DefaultValue.Numerator != 10 {
+					t.Errorf("node %s: unexpected mirror policy %#v", node.Name, policy)
+				}
+			case "vhost_alpha-next.svc":
+				if policy != nil {
+					t.Errorf("node %s: unexpected mirror policy to missing service %#v", node.Name, policy)
+				}
+			}
+		}
+		// the sidecar of the mirror accepts the shadow requests
+		if node.Name == "alpha-next.1" {
+			vhosts := node.routes[ingressRoute].VirtualHosts
+			assert.Assert(t, is.Len(vhosts, 1))
+			assert.DeepEqual(t, vhosts[0].Domains, []string{
+				"alpha-next.svc",
+				"alpha-next.svc:4100",
+				"alpha.svc-shadow",
+				"alpha.svc-shadow:4100",
+				"alpha.svc:4100-shadow",
+			})
+		}
+	}
+}
+
+func TestTransformAuthz(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name: "alpha.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationAuthzEnabled:       "",
+							AnnotationAuthzDisabledPaths: "/metrics",
+						},
+					},
+				},
+			},
+		},
+		"beta.1": {
+			{
+				Name: "beta.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.2",
+						Port:    1312,
+					},
+				},
+			},
+		},
+	}
+
+	// no mesh authz config: no authz at all
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if hasIngressFilter(t, node, util.HTTPExternalAuthorization) {
+			t.Errorf("node %s: unexpected authz filter", node.Name)
+		}
+	}
+
+	nodes, err = transform(test, nil, nil, MeshConfig{
+		Authz: &AuthzConfig{
+			Cluster: "authz",
+			Nodes:   []string{"ingress"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		expect := node.Name == "ingress" || node.Name == "alpha.1"
+		if hasIngressFilter(t, node, util.HTTPExternalAuthorization) != expect {
+			t.Errorf("node %s: expected authz filter: %t", node.Name, expect)
+		}
+		if node.Name != "alpha.1" {
+			continue
+		}
+		// health check path and disabled paths are exempt
+		routes := node.routes[ingressRoute].VirtualHosts[0].Routes
+		if len(routes) != 3 {
+			t.Fatalf("expected 3 routes, found %d", len(routes))
+		}
+		// the health check path is matched exactly
+		if routes[0].Match.PathSpecifier.(*route.RouteMatch_Path).Path != defaultHealthCheckPath {
+			t.Errorf("expected exact exempt route for %s, found %#v", defaultHealthCheckPath, routes[0].Match)
+		}
+		if routes[1].Match.PathSpecifier.(*route.RouteMatch_Prefix).Prefix != "/metrics" {
+			t.Errorf("expected exempt route for /metrics, found %#v", routes[1].Match)
+		}
+		for i := range routes[:2] {
+			if routes[i].PerFilterConfig[util.HTTPExternalAuthorization] == nil {
+				t.Errorf("missing authz route config for %#v", routes[i].Match)
+			}
+		}
+	}
+}
+
+func TestAuthzExempt(t *testing.T) {
+	mesh := MeshConfig{Authz: &AuthzConfig{Cluster: "authz"}}
+	paths, prefixes := mesh.authzExempt(parseClusterAnnotations(map[string]string{AnnotationAuthzDisabledPaths: "/metrics"}))
+	assert.DeepEqual(t, paths, []string{defaultHealthCheckPath})
+	assert.DeepEqual(t, prefixes, []string{"/metrics"})
+	paths, _ = mesh.authzExempt(parseClusterAnnotations(map[string]string{AnnotationProtocol: protocolGRPC}))
+	assert.DeepEqual(t, paths, []string{grpcHealthCheckPath})
+	paths, _ = mesh.authzExempt(parseClusterAnnotations(map[string]string{AnnotationProtocol: protocolTCP}))
+	assert.Assert(t, is.Len(paths, 0))
+}
+
+func TestTransformAuthzVersion(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{Name: "alpha.svc", Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312}}},
+			{Name: "beta.svc", Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312}}},
+		},
+	}
+	version := func(mesh MeshConfig) string {
+		nodes, err := transform(test, nil, nil, mesh)
+		assert.NilError(t, err)
+		for _, node := range nodes {
+			if node.Name == "alpha.1" {
+				return node.Version()
+			}
+		}
+		t.Fatal("missing node alpha.1")
+		return ""
+	}
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		Authz:             &AuthzConfig{Cluster: "authz", Nodes: []string{"alpha.1"}},
+	}
+	before := version(mesh)
+	// the version does not depend on map iteration order
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, version(mesh), before)
+	}
+	// authz is only part of the listeners
+	mesh.Authz.FailureModeAllow = true
+	assert.Assert(t, version(mesh) != before)
+}
+
+func hasIngressFilter(t *testing.T, node *Node, name string) bool {
+	for _, lis := range node.listeners {
+		if lis.Address.GetSocketAddress().GetPortValue() != defaultIngressTrafficPort {
+			continue
+		}
+		filters, err := getHTTPFilters(lis.FilterChains[0].Filters[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, filter := range filters {
+			if filter.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestTransformDependencies(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name: "alpha.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    1312,
+						Annotations: map[string]string{
+							AnnotationMirrorService: "gamma.svc",
+						},
+					},
+				},
+			},
+		},
+		"beta.1": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312}},
+			},
+		},
+		"gamma.1": {
+			{
+				Name:      "gamma.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.3", Port: 1312}},
+			},
+		},
+		"delta.1": {},
+	}
+	nodeConfigs := map[string]NodeConfig{
+		"beta.1":  {Dependencies: []string{"alpha.svc", "unknown.svc"}},
+		"gamma.1": {Dependencies: []string{"*"}},
+	}
+	expect := map[string][]string{
+		// mirror target is added as cluster, but not as vhost
+		"beta.1":  {"alpha.svc", "gamma.svc"},
+		"gamma.1": {"alpha.svc", "beta.svc", "gamma.svc"},
+		"alpha.1": nil,
+		"delta.1": nil,
+		"ingress": {"alpha.svc", "beta.svc", "gamma.svc"},
+	}
+
+	nodes, err := transform(test, nil, nodeConfigs, MeshConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		var clusters []string
+		for name := range node.clusters {
+			if !strings.HasPrefix(name, localClusterPrefix) {
+				clusters = append(clusters, name)
+			}
+		}
+		sort.Strings(clusters)
+		assert.DeepEqual(t, clusters, expect[node.Name])
+	}
+	for _, node := range nodes {
+		if node.Name != "beta.1" {
+			continue
+		}
+		vhosts := node.routes[egressRoute].VirtualHosts
+		assert.Assert(t, is.Len(vhosts, 1))
+		assert.Equal(t, vhosts[0].Name, "vhost_alpha.svc")
+	}
+
+	// nodes without dependencies may call all services
+	nodes, err = transform(test, nil, nodeConfigs, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Name == "delta.1" {
+			assert.Assert(t, is.Len(node.routes[egressRoute].VirtualHosts, 3))
+		}
+	}
+}
+
+func TestTransformTCP(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {},
+		"postgres.1": {
+			{
+				Name: "postgres.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.1",
+						Port:    5432,
+						Annotations: map[string]string{
+							AnnotationProtocol:      "tcp",
+							AnnotationTCPEgressPort: "5432",
+						},
+					},
+				},
+			},
+		},
+	}
+	nodes, err := transform(test, nil, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		ports := make(map[string]uint32)
+		for _, lis := range node.listeners {
+			ports[lis.Name] = lis.Address.GetSocketAddress().GetPortValue()
+		}
+		switch node.Name {
+		case "alpha.1":
+			assert.Equal(t, ports[tcpEgressListenerName("postgres.svc")], uint32(5432))
+			// egress endpoints point to the tcp ingress port
+			eps := node.endpoints["postgres.svc"].Endpoints[0].LbEndpoints
+			assert.Equal(t, getPort(eps[0]), uint32(5532))
+			assert.Assert(t, node.clusters["postgres.svc"].HealthChecks[0].GetTcpHealthCheck() != nil)
+			for _, vhost := range node.routes[egressRoute].VirtualHosts {
+				assert.Assert(t, vhost.Name != "vhost_postgres.svc")
+			}
+		case "postgres.1":
+			assert.Equal(t, ports[tcpIngressListenerName("postgres.svc")], uint32(5532))
+			assert.Assert(t, node.clusters["local_postgres.svc"] != nil)
+			assert.Assert(t, node.routes[ingressRoute] == nil)
+		case "ingress":
+			_, ok := ports[tcpEgressListenerName("postgres.svc")]
+			assert.Assert(t, !ok)
+		}
+	}
+}
+
+func TestTransformExternalServices(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name:      "alpha.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312}},
+			},
+		},
+	}
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		ExternalServices: []ExternalService{
+			{
+				Name:       "stripe",
+				Host:       "api.stripe.com",
+				Port:       443,
+				TLS:        true,
+				Resolution: "logical",
+			},
+			// conflicts with a mesh service
+			{Name: "alpha.svc", Host: "alpha.example.com", Port: 80},
+			// missing port
+			{Host: "example.com"},
+		},
+	}
+	nodes, err := transform(test, nil, nil, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		var vhosts []string
+		for _, vhost := range node.routes[egressRoute].GetVirtualHosts() {
+			vhosts = append(vhosts, vhost.Name)
+		}
+		for _, vhost := range node.routes[ingressRoute].GetVirtualHosts() {
+			vhosts = append(vhosts, vhost.Name)
+		}
+		switch node.Name {
+		case "alpha.1":
+			assert.DeepEqual(t, vhosts, []string{"vhost_alpha.svc", "vhost_stripe", "vhost_alpha.svc"})
+			c := node.clusters["stripe"]
+			assert.Equal(t, c.Type, v2.Cluster_LOGICAL_DNS)
+			assert.Assert(t, c.EdsClusterConfig == nil)
+			assert.Equal(t, c.TlsContext.Sni, "api.stripe.com")
+			// the server certificate is verified
+			validation := c.TlsContext.CommonTlsContext.GetValidationContext()
+			assert.Equal(t, validation.TrustedCa.GetFilename(), defaultCACertificate)
+			assert.DeepEqual(t, validation.VerifySubjectAltName, []string{"api.stripe.com"})
+			assert.Equal(t, getPort(c.LoadAssignment.Endpoints[0].LbEndpoints[0]), uint32(443))
+			_, ok := node.endpoints["stripe"]
+			assert.Assert(t, !ok)
+
+			vhost := node.routes[egressRoute].VirtualHosts[1]
+			assert.DeepEqual(t, vhost.Domains, []string{"stripe", "stripe:443"})
+			action := vhost.Routes[len(vhost.Routes)-1].GetRoute()
+			assert.Equal(t, action.GetHostRewrite(), "api.stripe.com")
+		case "ingress":
+			// external services are not exposed
+			assert.DeepEqual(t, vhosts, []string{"vhost_alpha.svc"})
+			assert.Assert(t, node.clusters["stripe"] == nil)
+		}
+	}
+}
+
+func TestTransformEgressGateway(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {},
+	}
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		ExternalServices: []ExternalService{
+			{Name: "stripe", Host: "api.stripe.com", Port: 443, TLS: true},
+			{Name: "github", Host: "api.github.com", Port: 443, TLS: true},
+			{Name: "grpcbin", Host: "grpcb.in", Port: 9001, Annotations: map[string]string{AnnotationProtocol: "grpc"}},
+		},
+		EgressGateway: &EgressGatewayConfig{
+			Address: "egress.internal",
+			Allow:   []string{"stripe", "grpcbin"},
+		},
+		RBAC: &RBACConfig{
+			Policies: []RBACPolicy{{From: []string{"alpha.svc"}, To: "stripe"}},
+		},
+	}
+	nodes, err := transform(test, nil, nil, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gateway bool
+	for _, node := range nodes {
+		switch node.Name {
+		case "alpha.1":
+			// external services are sent to the gateway
+			assert.Assert(t, node.clusters["stripe"] == nil)
+			assert.Assert(t, node.clusters["github"] == nil)
+			c := node.clusters[egressGatewayCluster]
+			assert.Equal(t, getPort(c.LoadAssignment.Endpoints[0].LbEndpoints[0]), uint32(defaultIngressTrafficPort))
+			assert.Assert(t, c.TlsContext == nil)
+			assert.Assert(t, c.Http2ProtocolOptions == nil)
+			// gRPC requests use HTTP/2 to the gateway
+			assert.Assert(t, node.clusters[egressGatewayHTTP2Cluster].Http2ProtocolOptions != nil)
+			vhosts := node.routes[egressRoute].VirtualHosts
+			assert.Assert(t, is.Len(vhosts, 2))
+			for _, vhost := range vhosts {
+				action := vhost.Routes[len(vhost.Routes)-1].GetRoute()
+				assert.Equal(t, action.GetHostRewrite(), "")
+				switch vhost.Name {
+				case "vhost_stripe":
+					assert.Equal(t, action.GetCluster(), egressGatewayCluster)
+				case "vhost_grpcbin":
+					assert.Equal(t, action.GetCluster(), egressGatewayHTTP2Cluster)
+				default:
+					t.Fatalf("unexpected vhost %s", vhost.Name)
+				}
+			}
+		case defaultEgressGatewayNode:
+			gateway = true
+			assert.Equal(t, node.clusters["stripe"].TlsContext.Sni, "api.stripe.com")
+			assert.Assert(t, node.clusters["github"] == nil)
+			assert.Assert(t, node.clusters["grpcbin"].Http2ProtocolOptions != nil)
+			vhosts := node.routes[ingressRoute].VirtualHosts
+			assert.Assert(t, is.Len(vhosts, 2))
+			for _, vhost := range vhosts {
+				if vhost.Name == "vhost_stripe" {
+					action := vhost.Routes[len(vhost.Routes)-1].GetRoute()
+					assert.Equal(t, action.GetHostRewrite(), "api.stripe.com")
+				}
+			}
+			assert.Assert(t, is.Len(node.listeners, 1))
+			assert.Equal(t, node.listeners[0].Address.GetSocketAddress().GetPortValue(), uint32(defaultIngressTrafficPort))
+			// the gateway enforces the policies of the external services
+			filters, err := getHTTPFilters(node.listeners[0].FilterChains[0].Filters[0])
+			assert.NilError(t, err)
+			assertHTTPFilters(t, filters, util.HTTPRoleBasedAccessControl, util.Router)
+		}
+	}
+	assert.Assert(t, gateway)
+}
+
+func TestTransformEgressGatewayVersion(t *testing.T) {
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		ExternalServices: []ExternalService{
+			{Name: "stripe", Host: "api.stripe.com", Port: 443, TLS: true},
+		},
+		EgressGateway: &EgressGatewayConfig{Address: "egress.internal", Allow: []string{allDependencies}},
+	}
+	version := func(mesh MeshConfig) string {
+		nodes, err := transform(map[string][]Cluster{}, nil, nil, mesh)
+		assert.NilError(t, err)
+		for _, node := range nodes {
+			if node.Name == defaultEgressGatewayNode {
+				return node.Version()
+			}
+		}
+		t.Fatal("missing egress gateway node")
+		return ""
+	}
+	before := version(mesh)
+	mesh.ExternalServices = append(mesh.ExternalServices, ExternalService{Name: "github", Host: "api.github.com", Port: 443, TLS: true})
+	assert.Assert(t, before != version(mesh))
+}
+
+func TestTransformIngressGateways(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name:      "alpha.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312}},
+			},
+			{
+				Name:      "internal.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1313}},
+			},
+		},
+	}
+	mesh := MeshConfig{
+		IngressGateways: []IngressGatewayConfig{
+			{
+				Node: "public",
+				Certificates: []TLSCertificateConfig{
+					{
+						Hosts:            []string{"example.com"},
+						CertificateChain: "/etc/envoy/example.crt",
+						PrivateKey:       "/etc/envoy/example.key",
+					},
+				},
+				Routes: []IngressRoute{
+					{Host: "example.com", Service: "alpha.svc"},
+					{Host: "example.com", PathPrefix: "/api", Service: "alpha.svc", PrefixRewrite: "/"},
+					{Host: "example.com", Service: "unknown.svc"},
+				},
+			},
+			{
+				Node:      "mixed",
+				Plaintext: true,
+				Certificates: []TLSCertificateConfig{
+					{
+						Hosts:            []string{"example.com"},
+						CertificateChain: "/etc/envoy/example.crt",
+						PrivateKey:       "/etc/envoy/example.key",
+					},
+				},
+				Routes: []IngressRoute{
+					{Host: "example.com", Service: "alpha.svc"},
+				},
+			},
+			// missing node
+			{},
+		},
+	}
+	nodes, err := transform(test, nil, nil, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+		if node.Name == "mixed" {
+			assert.Assert(t, is.Len(node.listeners, 2))
+			assert.DeepEqual(t, node.routes[ingressRoute].VirtualHosts[0].Domains, []string{"example.com", "example.com:4100", "example.com:4443"})
+		}
+		if node.Name != "public" {
+			continue
+		}
+		// only exposed services are reachable
+		assert.Assert(t, node.clusters["alpha.svc"] != nil)
+		assert.Assert(t, node.clusters["internal.svc"] == nil)
+
+		vhosts := node.routes[ingressRoute].VirtualHosts
+		assert.Assert(t, is.Len(vhosts, 1))
+		assert.DeepEqual(t, vhosts[0].Domains, []string{"example.com", "example.com:4443"})
+		assert.Assert(t, is.Len(vhosts[0].Routes, 2))
+		assert.Equal(t, vhosts[0].Routes[0].Match.GetPrefix(), "/api")
+		action := vhosts[0].Routes[0].GetRoute()
+		assert.Equal(t, action.PrefixRewrite, "/")
+		assert.Equal(t, action.GetHostRewrite(), "alpha.svc")
+		assert.Equal(t, vhosts[0].Routes[1].Match.GetPrefix(), "/")
+
+		// plaintext is opt-in with certificates
+		assert.Assert(t, is.Len(node.listeners, 1))
+		tls := node.listeners[0]
+		assert.Equal(t, tls.Address.GetSocketAddress().GetPortValue(), uint32(4443))
+		assert.Equal(t, tls.ListenerFilters[0].Name, util.TLSInspector)
+		assert.DeepEqual(t, tls.FilterChains[0].FilterChainMatch.ServerNames, []string{"example.com"})
+		assert.Equal(t, tls.FilterChains[0].TlsContext.CommonTlsContext.TlsCertificates[0].PrivateKey.GetFilename(), "/etc/envoy/example.key")
+		assert.Equal(t, tls.FilterChains[0].Filters[0].Name, util.HTTPConnectionManager)
+	}
+	// the default ingress gateway is replaced
+	sort.Strings(names)
+	assert.DeepEqual(t, names, []string{"alpha.1", "mixed", "public"})
+}
+
+func TestTransformListenerPorts(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {
+			{
+				Name:      "alpha.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.1", Port: 1312}},
+			},
+		},
+		"beta.1": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312}},
+			},
+		},
+	}
+	nodeConfigs := map[string]NodeConfig{
+		"beta.1": {Listeners: &ListenerPortsConfig{IngressPort: 4200}},
+	}
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		Listeners:         &ListenerPortsConfig{EgressAddress: "127.0.0.1"},
+	}
+	nodes, err := transform(test, nil, nodeConfigs, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Name != "alpha.1" && node.Name != "beta.1" {
+			continue
+		}
+		addrs := make(map[string]string)
+		ports := make(map[string]uint32)
+		for _, lis := range node.listeners {
+			addrs[lis.Name] = lis.Address.GetSocketAddress().GetAddress()
+			ports[lis.Name] = lis.Address.GetSocketAddress().GetPortValue()
+		}
+		assert.Equal(t, addrs["default-egress"], "127.0.0.1")
+		assert.Equal(t, addrs["default-ingress"], "0.0.0.0")
+		assert.Equal(t, ports["default-egress"], uint32(defaultEgressTrafficPort))
+		switch node.Name {
+		case "alpha.1":
+			assert.Equal(t, ports["default-ingress"], uint32(defaultIngressTrafficPort))
+			// the endpoints point to the ingress port of the callee
+			eps := node.endpoints["beta.svc"].Endpoints[0].LbEndpoints
+			assert.Equal(t, getPort(eps[0]), uint32(4200))
+		case "beta.1":
+			assert.Equal(t, ports["default-ingress"], uint32(4200))
+			eps := node.endpoints["alpha.svc"].Endpoints[0].LbEndpoints
+			assert.Equal(t, getPort(eps[0]), uint32(defaultIngressTrafficPort))
+		}
+	}
+}
+
+func TestTransformBindings(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {},
+		"beta.1": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312}},
+			},
+		},
+		"postgres.1": {
+			{
+				Name: "postgres.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.3",
+						Port:    5432,
+						Annotations: map[string]string{
+							AnnotationProtocol:      "tcp",
+							AnnotationTCPEgressPort: "5432",
+						},
+					},
+				},
+			},
+		},
+	}
+	nodeConfigs := map[string]NodeConfig{
+		"alpha.1": {
+			Dependencies: []string{"beta.svc", "postgres.svc"},
+			Bindings: []ServiceBinding{
+				{Service: "beta.svc", Port: 5001},
+				{Service: "postgres.svc", Address: "127.0.0.2", Port: 5002},
+				// a service may be bound twice
+				{Service: "beta.svc", Port: 5004},
+				// not a dependency
+				{Service: "gamma.svc", Port: 5003},
+				// port conflict
+				{Service: "beta.svc", Port: defaultEgressTrafficPort},
+			},
+		},
+	}
+	nodes, err := transform(test, nil, nodeConfigs, MeshConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Name != "alpha.1" {
+			continue
+		}
+		listeners := make(map[string]string)
+		for _, lis := range node.listeners {
+			addr := lis.Address.GetSocketAddress()
+			listeners[lis.Name] = fmt.Sprintf("%s:%d", addr.GetAddress(), addr.GetPortValue())
+		}
+		assert.Assert(t, is.Len(listeners, 6))
+		beta := ServiceBinding{Service: "beta.svc", Port: 5001}
+		assert.Equal(t, listeners[bindingListenerName(beta)], "127.0.0.1:5001")
+		assert.Equal(t, listeners[bindingListenerName(ServiceBinding{Service: "beta.svc", Port: 5004})], "127.0.0.1:5004")
+		assert.Equal(t, listeners[bindingListenerName(ServiceBinding{Service: "postgres.svc", Port: 5002})], "127.0.0.2:5002")
+
+		vhosts := node.routes[bindingRouteName(beta)].VirtualHosts
+		assert.Assert(t, is.Len(vhosts, 1))
+		assert.DeepEqual(t, vhosts[0].Domains, []string{"*"})
+		action := vhosts[0].Routes[len(vhosts[0].Routes)-1].GetRoute()
+		assert.Equal(t, action.GetCluster(), "beta.svc")
+		assert.Equal(t, action.GetHostRewrite(), "beta.svc")
+	}
+}
+
+func TestTransformTransparent(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {},
+		"beta.1": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.2", Port: 1312}},
+			},
+		},
+		"beta.2": {
+			{
+				Name:      "beta.svc",
+				Endpoints: []Endpoint{{Address: "1.1.1.3", Port: 1312}},
+			},
+		},
+		"postgres.1": {
+			{
+				Name: "postgres.svc",
+				Endpoints: []Endpoint{
+					{
+						Address: "1.1.1.4",
+						Port:    5432,
+						Annotations: map[string]string{
+							AnnotationProtocol:      "tcp",
+							AnnotationTCPEgressPort: "5432",
+						},
+					},
+				},
+			},
+		},
+	}
+	mesh := MeshConfig{
+		AllowAllByDefault: true,
+		Transparent:       &TransparentConfig{},
+	}
+	nodes, err := transform(test, nil, nil, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Name != "alpha.1" {
+			continue
+		}
+		var lis *v2.Listener
+		for _, l := range node.listeners {
+			if l.Name == transparentListenerName {
+				lis = l
+			}
+		}
+		assert.Assert(t, lis != nil)
+		assert.Equal(t, lis.Address.GetSocketAddress().GetPortValue(), uint32(defaultTransparentPort))
+		assert.Equal(t, lis.UseOriginalDst.Value, true)
+		assert.Equal(t, lis.ListenerFilters[0].Name, util.OriginalDestination)
+
+		// beta.svc, postgres.svc and the passthrough chain
+		assert.Assert(t, is.Len(lis.FilterChains, 3))
+		beta := lis.FilterChains[0]
+		assert.Equal(t, beta.FilterChainMatch.DestinationPort.Value, uint32(1312))
+		assert.Assert(t, is.Len(beta.FilterChainMatch.PrefixRanges, 2))
+		assert.Equal(t, beta.FilterChainMatch.PrefixRanges[0].AddressPrefix, "1.1.1.2")
+		assert.Equal(t, beta.Filters[0].Name, util.HTTPConnectionManager)
+		assert.Equal(t, lis.FilterChains[1].FilterChainMatch.DestinationPort.Value, uint32(5432))
+		assert.Equal(t, lis.FilterChains[1].Filters[0].Name, util.TCPProxy)
+		assert.Assert(t, lis.FilterChains[2].FilterChainMatch == nil)
+
+		vhosts := node.routes[transparentRouteName("beta.svc", 1312)].VirtualHosts
+		action := vhosts[0].Routes[len(vhosts[0].Routes)-1].GetRoute()
+		assert.Equal(t, action.GetHostRewrite(), "beta.svc")
+		assert.Equal(t, node.clusters[passthroughCluster].Type, v2.Cluster_ORIGINAL_DST)
+	}
+
+	// blocked unknown destinations without targets: only the blackhole chain
+	mesh.Transparent.BlockUnknown = true
+	nodes, err = transform(map[string][]Cluster{"alpha.1": {}}, nil, nil, mesh)
+	assert.NilError(t, err)
+	for _, node := range nodes {
+		if node.Name != "alpha.1" {
+			continue
+		}
+		var found bool
+		for _, lis := range node.listeners {
+			if lis.Name != transparentListenerName {
+				continue
+			}
+			found = true
+			assert.Assert(t, is.Len(lis.FilterChains, 1))
+			assert.Assert(t, lis.FilterChains[0].FilterChainMatch == nil)
+			assert.Equal(t, lis.FilterChains[0].Filters[0].Name, util.TCPProxy)
+		}
+		assert.Assert(t, found)
+		assert.Assert(t, node.clusters[passthroughCluster] == nil)
+		assert.Equal(t, node.clusters[blackholeCluster].Type, v2.Cluster_STATIC)
+	}
+}
+
+func TestServiceNames(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {{Name: "alpha.svc"}},
+		"alpha.2": {{Name: "alpha.svc"}, {Name: "beta.svc"}},
+	}
+	mesh := MeshConfig{
+		ExternalServices: []ExternalService{
+			{Name: "stripe", Host: "api.stripe.com", Port: 443},
+		},
+	}
+	assert.DeepEqual(t, serviceNames(test, nil, mesh), []string{"alpha.svc", "beta.svc", "stripe"})
+}
+
+func TestClusterConfigPrecedence(t *testing.T) {
+	cluster := Cluster{
+		Name: "beta.svc",
+		Annotations: map[string]string{
+			AnnotationTimeoutConnect: "2000",
+			AnnotationLBPolicy:       lbPolicyMaglev,
+		},
+		Endpoints: []Endpoint{
+			{Address: "10.0.0.2", Port: 3000, Annotations: map[string]string{AnnotationTimeoutConnect: "4000"}},
+			{Address: "10.0.0.1", Port: 3000, Annotations: map[string]string{AnnotationTimeoutConnect: "3000"}},
+		},
+	}
+	// the endpoint with the lowest address wins over the cluster
+	cfg := cluster.Config()
+	assert.Equal(t, cfg.Timeout.Connect, time.Millisecond*3000)
+	assert.Equal(t, cfg.LoadBalancer.Policy, lbPolicyMaglev)
+
+	cluster.Endpoints[0], cluster.Endpoints[1] = cluster.Endpoints[1], cluster.Endpoints[0]
+	assert.Equal(t, cluster.Config().Timeout.Connect, time.Millisecond*3000)
+}
+
+func TestTransformGlobalServices(t *testing.T) {
+	test := map[string][]Cluster{
+		"alpha.1": {},
+		"beta.1": {
+			{
+				Name:        "beta.svc",
+				Annotations: map[string]string{AnnotationTimeoutConnect: "5000"},
+				Endpoints:   []Endpoint{{Address: "10.0.0.1", Port: 3000}},
+			},
+		},
+	}
+	global := []Cluster{
+		{
+			Name:        "gamma.svc",
+			Annotations: map[string]string{AnnotationTimeoutConnect: "2000"},
+			Endpoints:   []Endpoint{{Address: "10.123.0.24", Port: 4100}},
+		},
+	}
+	nodes, err := transform(test, global, nil, MeshConfig{AllowAllByDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// global services don't have a sidecar
+	assert.Assert(t, is.Len(nodes, 3))
+	for _, node := range nodes {
+		if node.Name != "alpha.1" {
+			continue
+		}
+		// the endpoints of global services are called directly
+		assert.NilError(t, checkCluster(node, "gamma.svc", global[0].Endpoints))
+		assert.Equal(t, node.clusters["gamma.svc"].ConnectTimeout, time.Millisecond*2000)
+		assert.NilError(t, checkCluster(node, "beta.svc", []Endpoint{{Address: "10.0.0.1", Port: defaultIngressTrafficPort}}))
+		assert.Equal(t, node.clusters["beta.svc"].ConnectTimeout, time.Millisecond*5000)
+		assert.Assert(t, node.routes[egressRoute] != nil)
+		var vhosts []string
+		for _, vhost := range node.routes[egressRoute].VirtualHosts {
+			vhosts = append(vhosts, vhost.Name)
+		}
+		assert.Assert(t, is.Contains(vhosts, "vhost_gamma.svc"))
+	}
+	assert.DeepEqual(t, serviceNames(test, global, MeshConfig{}), []string{"beta.svc", "gamma.svc"})
+}
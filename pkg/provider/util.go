@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,48 +16,171 @@ func parseIntWithFallback(val string, fallback int) int {
 }
 
 func parseInt64RangeWithFallback(val string, fallback1, fallback2 int64) (int64, int64) {
+	num1, num2, err := parseInt64Range(val)
+	if err != nil {
+		return fallback1, fallback2
+	}
+	return num1, num2
+}
+
+// parseInt64Range parses a range like 200-400
+func parseInt64Range(val string) (int64, int64, error) {
 	list := strings.Split(val, "-")
 	if len(list) != 2 {
-		return fallback1, fallback2
+		return 0, 0, fmt.Errorf("invalid range %s", val)
 	}
 	num1, err := strconv.ParseInt(list[0], 10, 64)
 	if err != nil {
-		return fallback1, fallback2
+		return 0, 0, err
 	}
-	num2, err := strconv.ParseInt(list[2], 10, 64)
+	num2, err := strconv.ParseInt(list[1], 10, 64)
 	if err != nil {
-		return fallback1, fallback2
+		return 0, 0, err
 	}
-	return num1, num2
+	return num1, num2, nil
 }
 
 // MakeEgressEndpoints makes the endpoints point to the ingress port
-func makeEgressEndpoints(in []Endpoint) (out []Endpoint) {
+func makeEgressEndpoints(in []Endpoint, port uint32) (out []Endpoint) {
 	for _, ep := range in {
 		out = append(out, Endpoint{
 			Address:     ep.Address,
 			Annotations: ep.Annotations,
-			Port:        defaultIngressTrafficPort,
+			Port:        port,
 		})
 	}
 	return out
 }
 
-// makeEgressClusters makes the endpoints point to the ingress port
-func makeEgressClusters(in []Cluster) (out []Cluster) {
+// makeEgressClusters makes the endpoints point to the ingress port of the sidecar
+// the endpoints of tcp services point to the ingress port of the service
+func makeEgressClusters(in []Cluster, ingressPort uint32) (out []Cluster) {
 	for _, cluster := range in {
+		port := ingressPort
+		if cfg := cluster.Config(); cfg.Protocol == protocolTCP {
+			port = cfg.TCP.IngressPort
+		}
 		out = append(out, Cluster{
-			Name:      cluster.Name,
-			Endpoints: makeEgressEndpoints(cluster.Endpoints),
+			Name:        cluster.Name,
+			Annotations: cluster.Annotations,
+			Endpoints:   makeEgressEndpoints(cluster.Endpoints, port),
+			Routes:      cluster.Routes,
 		})
 	}
 	return out
 }
 
+// makeVersionClusters groups the endpoints of the clusters by their version
+// endpoints without a version are omitted
+func makeVersionClusters(in []Cluster) (out []Cluster) {
+	for _, cluster := range in {
+		versions := make(map[string][]Endpoint)
+		var order []string
+		for _, ep := range cluster.Endpoints {
+			version := ep.Config().Version
+			if version == "" {
+				continue
+			}
+			if versions[version] == nil {
+				order = append(order, version)
+			}
+			versions[version] = append(versions[version], ep)
+		}
+		for _, version := range order {
+			out = append(out, Cluster{
+				Name:        versionClusterName(cluster.Name, version),
+				Annotations: cluster.Annotations,
+				Endpoints:   versions[version],
+			})
+		}
+	}
+	return out
+}
+
+// serviceVersions returns the versions of the endpoints per service
+func serviceVersions(providerClusters map[string][]Cluster, globalServices []Cluster) map[string]map[string]struct{} {
+	out := make(map[string]map[string]struct{})
+	add := func(clusters []Cluster) {
+		for _, cluster := range clusters {
+			for _, ep := range cluster.Endpoints {
+				version := ep.Config().Version
+				if version == "" {
+					continue
+				}
+				if out[cluster.Name] == nil {
+					out[cluster.Name] = make(map[string]struct{})
+				}
+				out[cluster.Name][version] = struct{}{}
+			}
+		}
+	}
+	add(globalServices)
+	for _, clusters := range providerClusters {
+		add(clusters)
+	}
+	return out
+}
+
+// localClusterName returns the name of the cluster which
+// contains the local endpoints of a service, e.g. local_beta.svc
+func localClusterName(cluster string) string {
+	return fmt.Sprintf("%s_%s", localClusterPrefix, cluster)
+}
+
+// versionClusterName returns the name of the cluster which contains
+// the endpoints of a specific service version, e.g. beta.svc@v2
+func versionClusterName(cluster, version string) string {
+	return fmt.Sprintf("%s@%s", cluster, version)
+}
+
+// versionClusterService returns the service of a version cluster
+func versionClusterService(cluster string) string {
+	return strings.SplitN(cluster, "@", 2)[0]
+}
+
+// parseVersionWeights parses a list of version=weight pairs
+// the weights must add up to 100
+func parseVersionWeights(val string) ([]VersionWeight, error) {
+	var out []VersionWeight
+	var total uint32
+	for _, pair := range strings.Split(val, ",") {
+		list := strings.Split(strings.TrimSpace(pair), "=")
+		if len(list) != 2 || list[0] == "" {
+			return nil, fmt.Errorf("invalid pair %s", pair)
+		}
+		weight, err := strconv.ParseUint(list[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		total += uint32(weight)
+		out = append(out, VersionWeight{
+			Version: list[0],
+			Weight:  uint32(weight),
+		})
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("weights add up to %d", total)
+	}
+	return out, nil
+}
+
+// mergeAnnotations merges the annotations of the cluster and its endpoints
+// endpoint annotations override cluster annotations, if endpoints disagree
+// the endpoint with the lowest address:port wins
 func mergeAnnotations(cluster Cluster) map[string]string {
 	out := make(map[string]string)
-	for _, ep := range cluster.Endpoints {
-		for k, v := range ep.Annotations {
+	for k, v := range cluster.Annotations {
+		out[k] = v
+	}
+	endpoints := append([]Endpoint(nil), cluster.Endpoints...)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return endpoints[i].Address < endpoints[j].Address
+		}
+		return endpoints[i].Port < endpoints[j].Port
+	})
+	for i := len(endpoints) - 1; i >= 0; i-- {
+		for k, v := range endpoints[i].Annotations {
 			out[k] = v
 		}
 	}